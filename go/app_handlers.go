@@ -7,9 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
@@ -52,8 +55,8 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 
 	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, accessToken, invitationCode,
+		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, invitation_code) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, invitationCode,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -119,16 +122,18 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	expiresAt, err := createSession(ctx, tx, sessionRoleApp, userID, accessToken)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "app_session",
-		Value: accessToken,
-	})
+	setSessionCookie(w, sessionRoleApp, accessToken, expiresAt)
 
 	writeJSON(w, http.StatusCreated, &appPostUsersResponse{
 		ID:             userID,
@@ -136,8 +141,18 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func appPostLogout(w http.ResponseWriter, r *http.Request) {
+	postSessionLogout(w, r, sessionRoleApp)
+}
+
+func appPostRotateToken(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	postSessionRotate(w, r, sessionRoleApp, user.ID)
+}
+
 type appPostPaymentMethodsRequest struct {
-	Token string `json:"token"`
+	Token     string `json:"token"`
+	IsDefault bool   `json:"is_default"`
 }
 
 func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
@@ -154,13 +169,157 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 
 	user := ctx.Value("user").(*User)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 最初に登録された決済トークンは必ずデフォルトにする
+	registeredCount := 0
+	if err := tx.GetContext(ctx, &registeredCount, `SELECT COUNT(*) FROM payment_tokens WHERE user_id = ? FOR UPDATE`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	isDefault := req.IsDefault || registeredCount == 0
+	if isDefault {
+		if _, err := tx.ExecContext(ctx, `UPDATE payment_tokens SET is_default = FALSE WHERE user_id = ?`, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	_, err = tx.ExecContext(
 		ctx,
-		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
+		`INSERT INTO payment_tokens (user_id, token, is_default) VALUES (?, ?, ?)`,
 		user.ID,
 		req.Token,
+		isDefault,
 	)
 	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDupEntry {
+			writeError(w, http.StatusConflict, errors.New("payment token already registered"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type appGetPaymentMethodsResponse struct {
+	PaymentMethods []appGetPaymentMethodsResponseItem `json:"payment_methods"`
+}
+
+type appGetPaymentMethodsResponseItem struct {
+	Token        string `json:"token"`
+	IsDefault    bool   `json:"is_default"`
+	RegisteredAt int64  `json:"registered_at"`
+}
+
+func appGetPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	paymentTokens := []PaymentToken{}
+	if err := db.SelectContext(ctx, &paymentTokens, `SELECT *, is_default FROM payment_tokens WHERE user_id = ? ORDER BY created_at ASC`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]appGetPaymentMethodsResponseItem, 0, len(paymentTokens))
+	for _, paymentToken := range paymentTokens {
+		items = append(items, appGetPaymentMethodsResponseItem{
+			Token:        paymentToken.Token,
+			IsDefault:    paymentToken.IsDefault,
+			RegisteredAt: paymentToken.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetPaymentMethodsResponse{
+		PaymentMethods: items,
+	})
+}
+
+func appDeletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := r.PathValue("token")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	paymentToken := &PaymentToken{}
+	if err := tx.GetContext(ctx, paymentToken, `SELECT *, is_default FROM payment_tokens WHERE user_id = ? AND token = ? FOR UPDATE`, user.ID, token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM payment_tokens WHERE user_id = ? AND token = ?`, user.ID, token); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// デフォルトを削除した場合は残っている中で最も古いものをデフォルトにする
+	if paymentToken.IsDefault {
+		if _, err := tx.ExecContext(ctx, `UPDATE payment_tokens SET is_default = TRUE WHERE user_id = ? ORDER BY created_at ASC LIMIT 1`, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func appPostPaymentMethodDefault(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := r.PathValue("token")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	registeredCount := 0
+	if err := tx.GetContext(ctx, &registeredCount, `SELECT COUNT(*) FROM payment_tokens WHERE user_id = ? AND token = ? FOR UPDATE`, user.ID, token); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if registeredCount == 0 {
+		writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE payment_tokens SET is_default = (token = ?) WHERE user_id = ?`, token, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -170,17 +329,22 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 
 type getAppRidesResponse struct {
 	Rides []getAppRidesResponseItem `json:"rides"`
+	// 続きがあるときだけ返す。次のページを取得するときに cursor に指定する
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type getAppRidesResponseItem struct {
-	ID                    string                       `json:"id"`
-	PickupCoordinate      Coordinate                   `json:"pickup_coordinate"`
-	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
-	Chair                 getAppRidesResponseItemChair `json:"chair"`
-	Fare                  int                          `json:"fare"`
-	Evaluation            int                          `json:"evaluation"`
-	RequestedAt           int64                        `json:"requested_at"`
-	CompletedAt           int64                        `json:"completed_at"`
+	ID                    string                        `json:"id"`
+	Status                string                        `json:"status"`
+	PickupCoordinate      Coordinate                    `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate                    `json:"destination_coordinate"`
+	Chair                 *getAppRidesResponseItemChair `json:"chair"`
+	Fare                  int                           `json:"fare"`
+	RefundedAmount        int                           `json:"refunded_amount"`
+	Evaluation            *int                          `json:"evaluation"`
+	RequestedAt           int64                         `json:"requested_at"`
+	CompletedAt           *int64                        `json:"completed_at"`
+	ScheduledAt           *int64                        `json:"scheduled_at,omitempty"`
 }
 
 type getAppRidesResponseItemChair struct {
@@ -190,66 +354,350 @@ type getAppRidesResponseItemChair struct {
 	Model string `json:"model"`
 }
 
+var (
+	allRideStatuses        = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED", "COMPLETED", "CANCELED"}
+	inProgressRideStatuses = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED"}
+)
+
+// appGetRides は利用者のライド履歴を新しい順に返す。
+// limit を省略した場合は従来通り条件に合うライドをすべて返し、指定した場合は cursor (ライドID) より古いものを limit 件ずつ返す
 func appGetRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
+	query := r.URL.Query()
 
-	tx, err := db.Beginx()
+	conditions := []string{"r.user_id = ?"}
+	args := []interface{}{user.ID}
+
+	if query.Get("since") != "" || query.Get("until") != "" {
+		since, until, err := parseTimeRangeQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		conditions = append(conditions, "r.created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND")
+		args = append(args, since, until)
+	}
+
+	// 省略された場合は従来通り完了済みのライドだけを返す
+	statuses := []string{"COMPLETED"}
+	if query.Get("status") != "" {
+		statuses = strings.Split(query.Get("status"), ",")
+		for _, status := range statuses {
+			if !slices.Contains(allRideStatuses, status) {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid status: %s", status))
+				return
+			}
+		}
+	}
+	if query.Get("include_in_progress") == "true" {
+		statuses = append(statuses, inProgressRideStatuses...)
+	}
+	statusCondition, statusArgs, err := sqlx.In("r.latest_status IN (?)", statuses)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
+	conditions = append(conditions, statusCondition)
+	args = append(args, statusArgs...)
 
-	rides := []Ride{}
-	if err := tx.SelectContext(
+	// limit を省略した場合は 0 になり、件数を絞らない
+	page, err := parsePageParams(r, 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if page.Cursor != "" {
+		// ライドIDは ULID なので、IDの順序が依頼日時の順序になる
+		conditions = append(conditions, "r.id < ?")
+		args = append(args, page.Cursor)
+	}
+	limit := page.Limit
+	limitClause := ""
+	if limit > 0 {
+		// 続きがあるかどうかを知るために1件多く取得する
+		limitClause = " LIMIT ?"
+		args = append(args, limit+1)
+	}
+
+	rows := []struct {
+		ID                   string         `db:"id"`
+		Status               string         `db:"latest_status"`
+		PickupLatitude       int            `db:"pickup_latitude"`
+		PickupLongitude      int            `db:"pickup_longitude"`
+		DestinationLatitude  int            `db:"destination_latitude"`
+		DestinationLongitude int            `db:"destination_longitude"`
+		Evaluation           *int           `db:"evaluation"`
+		CreatedAt            time.Time      `db:"created_at"`
+		UpdatedAt            time.Time      `db:"updated_at"`
+		ScheduledAt          *time.Time     `db:"scheduled_at"`
+		Distance             int            `db:"distance"`
+		Pooled               bool           `db:"pooled"`
+		ChairID              sql.NullString `db:"chair_id"`
+		ChairName            sql.NullString `db:"chair_name"`
+		ChairModel           sql.NullString `db:"chair_model"`
+		OwnerName            sql.NullString `db:"owner_name"`
+		CouponDiscount       int            `db:"coupon_discount"`
+		PaymentAmount        *int           `db:"payment_amount"`
+		RefundedAmount       int            `db:"refunded_amount"`
+	}{}
+	if err := db.SelectContext(
 		ctx,
-		&rides,
-		`SELECT *, latest_status FROM rides WHERE user_id = ? AND latest_status = 'COMPLETED' ORDER BY created_at DESC`,
-		user.ID,
+		&rows,
+		`SELECT r.id, r.latest_status, r.pickup_latitude, r.pickup_longitude, r.destination_latitude, r.destination_longitude,
+		        r.evaluation, r.created_at, r.updated_at, r.scheduled_at, r.distance, r.pooled,
+		        c.id AS chair_id, c.name AS chair_name, c.model AS chair_model, o.name AS owner_name,
+		        COALESCE(cp.discount, 0) AS coupon_discount, p.amount AS payment_amount,
+		        CAST(COALESCE((SELECT SUM(rf.amount) FROM ride_refunds rf WHERE rf.ride_id = r.id AND rf.status = 'COMPLETED'), 0) AS SIGNED) AS refunded_amount
+		 FROM rides r
+		 LEFT JOIN chairs c ON c.id = r.chair_id
+		 LEFT JOIN owners o ON o.id = c.owner_id
+		 LEFT JOIN coupons cp ON cp.used_by = r.id
+		 LEFT JOIN ride_payments p ON p.ride_id = r.id
+		 WHERE `+strings.Join(conditions, " AND ")+`
+		 ORDER BY r.id DESC`+limitClause,
+		args...,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	items := []getAppRidesResponseItem{}
-	for _, ride := range rides {
+	res := &getAppRidesResponse{
+		Rides: []getAppRidesResponseItem{},
+	}
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+		res.NextCursor = rows[limit-1].ID
+	}
+	for _, row := range rows {
+		item := getAppRidesResponseItem{
+			ID:                    row.ID,
+			Status:                row.Status,
+			PickupCoordinate:      Coordinate{Latitude: row.PickupLatitude, Longitude: row.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: row.DestinationLatitude, Longitude: row.DestinationLongitude},
+			Fare:                  chargedFare(row.Distance, row.Pooled, row.CouponDiscount, row.PaymentAmount),
+			RefundedAmount:        row.RefundedAmount,
+			Evaluation:            row.Evaluation,
+			RequestedAt:           row.CreatedAt.UnixMilli(),
+		}
+		if row.Status == "COMPLETED" {
+			// updated_at は ride_statuses のトリガーで最後のステータスの日時になっている
+			completedAt := row.UpdatedAt.UnixMilli()
+			item.CompletedAt = &completedAt
+		}
+		if row.ScheduledAt != nil {
+			scheduledAt := row.ScheduledAt.UnixMilli()
+			item.ScheduledAt = &scheduledAt
+		}
+		if row.ChairID.Valid {
+			item.Chair = &getAppRidesResponseItemChair{
+				ID:    row.ChairID.String,
+				Owner: row.OwnerName.String,
+				Name:  row.ChairName.String,
+				Model: row.ChairModel.String,
+			}
+		}
+		res.Rides = append(res.Rides, item)
+	}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
+	writeJSON(w, http.StatusOK, res)
+}
+
+type appGetRideResponse struct {
+	ID                    string                        `json:"id"`
+	Status                string                        `json:"status"`
+	PickupCoordinate      Coordinate                    `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate                    `json:"destination_coordinate"`
+	Waypoints             []rideStop                    `json:"waypoints"`
+	Pooled                bool                          `json:"pooled"`
+	Timeline              []appGetRideResponseStatus    `json:"timeline"`
+	Chair                 *getAppRidesResponseItemChair `json:"chair"`
+	Fare                  appGetRideResponseFare        `json:"fare"`
+	Coupon                *appGetRideResponseCoupon     `json:"coupon"`
+	Evaluation            *int                          `json:"evaluation"`
+	Payment               appGetRideResponsePayment     `json:"payment"`
+	RequestedAt           int64                         `json:"requested_at"`
+	ScheduledAt           *int64                        `json:"scheduled_at,omitempty"`
+}
+
+type appGetRideResponseStatus struct {
+	Status string `json:"status"`
+	// 到着した経由地の順番。status が WAYPOINT の場合のみ
+	WaypointIndex *int  `json:"waypoint_index,omitempty"`
+	CreatedAt     int64 `json:"created_at"`
+}
+
+type appGetRideResponseFare struct {
+	Distance    int `json:"distance"`
+	InitialFare int `json:"initial_fare"`
+	MeteredFare int `json:"metered_fare"`
+	Discount    int `json:"discount"`
+	Total       int `json:"total"`
+}
+
+type appGetRideResponseCoupon struct {
+	Code     string `json:"code"`
+	Discount int    `json:"discount"`
+}
+
+type appGetRideResponsePayment struct {
+	// UNPAID, PAID, PARTIALLY_REFUNDED, REFUNDED のいずれか
+	Status         string                            `json:"status"`
+	Amount         *int                              `json:"amount"`
+	RefundedAmount int                               `json:"refunded_amount"`
+	PaidAt         *int64                            `json:"paid_at"`
+	Refunds        []appGetRideResponsePaymentRefund `json:"refunds"`
+}
+
+type appGetRideResponsePaymentRefund struct {
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// appGetRide は利用者自身のライド1件の詳細を返す
+func appGetRide(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride, status, err := authorizeRide(ctx, tx, rideID, actionRideRead, false)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	statuses := []RideStatus{}
+	if err := tx.SelectContext(ctx, &statuses, `SELECT *, waypoint_seq FROM ride_statuses WHERE ride_id = ? ORDER BY created_at`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	waypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := appGetRideResponse{
+		ID:                    ride.ID,
+		Status:                "MATCHING",
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Waypoints:             toRideStops(waypoints),
+		Pooled:                ride.Pooled,
+		Timeline:              make([]appGetRideResponseStatus, 0, len(statuses)),
+		Evaluation:            ride.Evaluation,
+		RequestedAt:           ride.CreatedAt.UnixMilli(),
+	}
+	if ride.LatestStatus.Valid {
+		res.Status = ride.LatestStatus.String
+	}
+	if ride.ScheduledAt != nil {
+		scheduledAt := ride.ScheduledAt.UnixMilli()
+		res.ScheduledAt = &scheduledAt
+	}
+	for _, status := range statuses {
+		res.Timeline = append(res.Timeline, appGetRideResponseStatus{
+			Status:        status.Status,
+			WaypointIndex: status.WaypointSeq,
+			CreatedAt:     status.CreatedAt.UnixMilli(),
+		})
+	}
+
+	if ride.ChairID.Valid {
+		chair := struct {
+			ID        string `db:"id"`
+			Name      string `db:"name"`
+			Model     string `db:"model"`
+			OwnerName string `db:"owner_name"`
+		}{}
+		if err := tx.GetContext(
+			ctx,
+			&chair,
+			`SELECT c.id, c.name, c.model, o.name AS owner_name FROM chairs c INNER JOIN owners o ON o.id = c.owner_id WHERE c.id = ?`,
+			ride.ChairID.String,
+		); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-
-		item := getAppRidesResponseItem{
-			ID:                    ride.ID,
-			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
-			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
-			Evaluation:            *ride.Evaluation,
-			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
+		res.Chair = &getAppRidesResponseItemChair{
+			ID:    chair.ID,
+			Owner: chair.OwnerName,
+			Name:  chair.Name,
+			Model: chair.Model,
 		}
+	}
 
-		item.Chair = getAppRidesResponseItemChair{}
+	couponDiscount := 0
+	coupon := &Coupon{}
+	if err := tx.GetContext(ctx, coupon, `SELECT * FROM coupons WHERE used_by = ?`, ride.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		couponDiscount = coupon.Discount
+		res.Coupon = &appGetRideResponseCoupon{
+			Code:     coupon.Code,
+			Discount: coupon.Discount,
+		}
+	}
 
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+	res.Payment = appGetRideResponsePayment{
+		Status:  "UNPAID",
+		Refunds: []appGetRideResponsePaymentRefund{},
+	}
+	var paymentAmount *int
+	payment := &RidePayment{}
+	if err := tx.GetContext(ctx, payment, `SELECT * FROM ride_payments WHERE ride_id = ?`, ride.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
+	} else {
+		paymentAmount = &payment.Amount
+		paidAt := payment.CreatedAt.UnixMilli()
+		res.Payment.Amount = &payment.Amount
+		res.Payment.PaidAt = &paidAt
 
-		owner := &Owner{}
-		if err := tx.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
+		refunds := []RideRefund{}
+		if err := tx.SelectContext(ctx, &refunds, `SELECT * FROM ride_refunds WHERE ride_id = ? AND status = 'COMPLETED' ORDER BY created_at`, ride.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		item.Chair.Owner = owner.Name
+		for _, refund := range refunds {
+			res.Payment.RefundedAmount += refund.Amount
+			res.Payment.Refunds = append(res.Payment.Refunds, appGetRideResponsePaymentRefund{
+				Amount:    refund.Amount,
+				Reason:    refund.Reason,
+				CreatedAt: refund.CreatedAt.UnixMilli(),
+			})
+		}
+		switch {
+		case res.Payment.RefundedAmount == 0:
+			res.Payment.Status = "PAID"
+		case res.Payment.RefundedAmount < payment.Amount:
+			res.Payment.Status = "PARTIALLY_REFUNDED"
+		default:
+			res.Payment.Status = "REFUNDED"
+		}
+	}
 
-		items = append(items, item)
+	// 決済前の運賃は、適用済みのクーポンから calculateDiscountedFare と同じ計算で求める
+	total := chargedFare(ride.Distance, ride.Pooled, couponDiscount, paymentAmount)
+	res.Fare = appGetRideResponseFare{
+		Distance:    ride.Distance,
+		InitialFare: initialFare,
+		MeteredFare: farePerDistance * ride.Distance,
+		Discount:    initialFare + farePerDistance*ride.Distance - total,
+		Total:       total,
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -257,14 +705,20 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, &getAppRidesResponse{
-		Rides: items,
-	})
+	writeJSON(w, http.StatusOK, res)
 }
 
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 配車位置から目的地までに順に立ち寄る経由地
+	Waypoints []Coordinate `json:"waypoints"`
+	// 相乗りを希望するかどうか。相乗りのライドは運賃が割り引かれる
+	Pooled bool `json:"pooled"`
+	// 省略された場合は決済時点のデフォルトの決済トークンを使う
+	PaymentToken *string `json:"payment_token"`
+	// 配車を予約する日時 (UnixMilli)。省略された場合はすぐに配車する
+	ScheduledAt *int64 `json:"scheduled_at"`
 }
 
 type appPostRidesResponse struct {
@@ -272,6 +726,12 @@ type appPostRidesResponse struct {
 	Fare   int    `json:"fare"`
 }
 
+// 予約されたライドは配車日時のこの時間前からマッチングの対象になり、それまではキャンセルできる
+var scheduledRideLeadTime = envDuration("ISUCON_SCHEDULED_RIDE_LEAD_TIME", 10*time.Minute, 0)
+
+// 予約できるのはこの期間先までの配車
+const scheduledRideMaxAdvance = 7 * 24 * time.Hour
+
 type executableGet interface {
 	Get(dest interface{}, query string, args ...interface{}) error
 	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
@@ -299,6 +759,24 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateWaypoints(req.Waypoints); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pooled && len(req.Waypoints) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("waypoints cannot be used with pooled rides"))
+		return
+	}
+	var scheduledAt *time.Time
+	if req.ScheduledAt != nil {
+		t := time.UnixMilli(*req.ScheduledAt)
+		// 準備時間より先でなければ予約する意味がないので、すぐに配車するライドとして依頼してもらう
+		if now := time.Now(); t.Before(now.Add(scheduledRideLeadTime)) || t.After(now.Add(scheduledRideMaxAdvance)) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("scheduled_at must be between %s and %s from now", scheduledRideLeadTime, scheduledRideMaxAdvance))
+			return
+		}
+		scheduledAt = &t
+	}
 
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
@@ -311,7 +789,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	continuingRideCount := 0
-	if err := tx.GetContext(ctx, &continuingRideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND (latest_status IS NULL OR latest_status != 'COMPLETED')`, user.ID); err != nil {
+	if err := tx.GetContext(ctx, &continuingRideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND (latest_status IS NULL OR latest_status NOT IN ('COMPLETED', 'CANCELED'))`, user.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -321,15 +799,32 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.PaymentToken != nil {
+		registered := false
+		if err := tx.GetContext(ctx, &registered, `SELECT EXISTS (SELECT 1 FROM payment_tokens WHERE user_id = ? AND token = ?)`, user.ID, *req.PaymentToken); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !registered {
+			writeError(w, http.StatusBadRequest, errors.New("payment_token is not registered"))
+			return
+		}
+	}
+
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, payment_token, scheduled_at, distance, pooled)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, req.PaymentToken, scheduledAt,
+		calculateRouteDistance(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate), req.Pooled,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if err := createRideWaypoints(ctx, tx, rideID, req.Waypoints); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	if _, err := tx.ExecContext(
 		ctx,
@@ -401,12 +896,12 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ride := Ride{}
-	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+	if err := tx.GetContext(ctx, &ride, "SELECT *, distance, pooled FROM rides WHERE id = ?", rideID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.Distance, ride.Pooled)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -423,9 +918,64 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// appPostRideCancel は予約したライドをキャンセルする。マッチングの対象になった後はキャンセルできない
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride, status, err := authorizeRide(ctx, tx, rideID, actionRideCancel, true)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if ride.ScheduledAt == nil {
+		writeError(w, http.StatusBadRequest, errors.New("only scheduled rides can be canceled"))
+		return
+	}
+	if ride.ChairID.Valid || !ride.LatestStatus.Valid || ride.LatestStatus.String != "MATCHING" || !time.Now().Before(ride.ScheduledAt.Add(-scheduledRideLeadTime)) {
+		writeError(w, http.StatusConflict, errors.New("ride can no longer be canceled"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`, ulid.Make().String(), ride.ID, "CANCELED"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 依頼時に適用したクーポンは次のライドで使えるように戻す
+	if _, err := tx.ExecContext(ctx, `UPDATE coupons SET used_by = NULL WHERE used_by = ?`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	notificationMutex.RLock()
+	if ch, ok := appNotificationChannels[ride.UserID]; ok {
+		select {
+		case ch <- struct{}{}:
+		default: // ブロッキング回避
+		}
+	}
+	notificationMutex.RUnlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type appPostRidesEstimatedFareRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
+	Pooled                bool         `json:"pooled"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
@@ -444,6 +994,15 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateWaypoints(req.Waypoints); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pooled && len(req.Waypoints) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("waypoints cannot be used with pooled rides"))
+		return
+	}
+	distance := calculateRouteDistance(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate)
 
 	user := ctx.Value("user").(*User)
 
@@ -454,7 +1013,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, distance, req.Pooled)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -467,7 +1026,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
 		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Discount: calculateFare(distance) - discounted,
 	})
 }
 
@@ -484,6 +1043,9 @@ func abs(a int) int {
 
 type appPostRideEvaluationRequest struct {
 	Evaluation int `json:"evaluation"`
+	// 省略可能。タグは reviewTags のいずれか
+	Comment string   `json:"comment"`
+	Tags    []string `json:"tags"`
 }
 
 type appPostRideEvaluationResponse struct {
@@ -503,6 +1065,10 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
 		return
 	}
+	if err := validateReview(req.Comment, req.Tags); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -511,13 +1077,9 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT *, latest_status FROM rides WHERE id = ?`, rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, errors.New("ride not found"))
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
+	ride, status, err := authorizeRide(ctx, tx, rideID, actionRideEvaluate, false)
+	if err != nil {
+		writeError(w, status, err)
 		return
 	}
 
@@ -551,7 +1113,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+	if err := tx.GetContext(ctx, ride, `SELECT *, distance, pooled FROM rides WHERE id = ?`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -560,8 +1122,16 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// ライド要求時に選択された決済トークンを優先し、削除されていればデフォルトのものを使う
 	paymentToken := &PaymentToken{}
-	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
+	if err := tx.GetContext(
+		ctx,
+		paymentToken,
+		`SELECT *, is_default FROM payment_tokens WHERE user_id = ?
+		 ORDER BY token = (SELECT payment_token FROM rides WHERE id = ?) DESC, is_default DESC, created_at ASC
+		 LIMIT 1`,
+		ride.UserID, ride.ID,
+	); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
 			return
@@ -570,7 +1140,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.Distance, ride.Pooled)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -585,13 +1155,20 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
+	gatewayPaymentID, err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
+		// 決済マイクロサービスの決済は決済トークンごとなので、同じトークンで決済したライドと今回のライドを数える
 		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
+		if err := tx.SelectContext(
+			ctx,
+			&rides,
+			`SELECT r.* FROM rides r LEFT JOIN ride_payments p ON p.ride_id = r.id WHERE p.token = ? OR r.id = ? ORDER BY r.created_at ASC`,
+			paymentToken.Token, ride.ID,
+		); err != nil {
 			return nil, err
 		}
 		return rides, nil
-	}); err != nil {
+	})
+	if err != nil {
 		if errors.Is(err, erroredUpstream) {
 			writeError(w, http.StatusBadGateway, err)
 			return
@@ -600,6 +1177,41 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 返金できるように決済内容を記録しておく
+	var gatewayPaymentIDOrNull *string
+	if gatewayPaymentID != "" {
+		gatewayPaymentIDOrNull = &gatewayPaymentID
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ride_payments (ride_id, user_id, token, amount, gateway_payment_id) VALUES (?, ?, ?, ?, ?)`,
+		ride.ID, ride.UserID, paymentToken.Token, fare, gatewayPaymentIDOrNull,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 椅子の評価の集計を更新
+	if err := addChairRideStats(ctx, tx, ride.ChairID.String, req.Evaluation); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := createRideReview(ctx, tx, ride, req.Comment, req.Tags); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// オーナー向けの売上集計を更新。トリガーにより updated_at は COMPLETED になった日時
+	if err := addChairSalesRollup(ctx, tx, ride.ChairID.String, ride.UpdatedAt, chairSalesRollupDelta{
+		Sales:         fare,
+		RidesCount:    1,
+		EvaluationSum: req.Evaluation,
+		Distance:      ride.Distance,
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -624,6 +1236,9 @@ type appGetNotificationResponseData struct {
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
+	ScheduledAt           *int64                           `json:"scheduled_at,omitempty"`
+	// 到着した経由地の順番。status が WAYPOINT の場合のみ
+	WaypointIndex *int `json:"waypoint_index,omitempty"`
 }
 
 type appGetNotificationResponseChair struct {
@@ -675,7 +1290,7 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		}
 
 		ride := &Ride{}
-		if err := tx.GetContext(ctx, ride, `SELECT *, latest_status FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+		if err := tx.GetContext(ctx, ride, `SELECT *, latest_status, scheduled_at, distance, pooled FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
 			tx.Rollback()
 			if errors.Is(err, sql.ErrNoRows) {
 				return
@@ -685,7 +1300,7 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 
 		// 未送信の状態を取得
 		yetSentRideStatuses := []RideStatus{}
-		if err := tx.SelectContext(ctx, &yetSentRideStatuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC`, ride.ID); err != nil {
+		if err := tx.SelectContext(ctx, &yetSentRideStatuses, `SELECT *, waypoint_seq FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC`, ride.ID); err != nil {
 			tx.Rollback()
 			return
 		}
@@ -698,7 +1313,7 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 
 		// 各未送信状態を順次送信
 		for _, rideStatus := range yetSentRideStatuses {
-			fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+			fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.Distance, ride.Pooled)
 			if err != nil {
 				tx.Rollback()
 				return
@@ -714,10 +1329,15 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 					Latitude:  ride.DestinationLatitude,
 					Longitude: ride.DestinationLongitude,
 				},
-				Fare:      fare,
-				Status:    rideStatus.Status,
-				CreatedAt: ride.CreatedAt.UnixMilli(),
-				UpdateAt:  ride.UpdatedAt.UnixMilli(),
+				Fare:          fare,
+				Status:        rideStatus.Status,
+				CreatedAt:     ride.CreatedAt.UnixMilli(),
+				UpdateAt:      ride.UpdatedAt.UnixMilli(),
+				WaypointIndex: rideStatus.WaypointSeq,
+			}
+			if ride.ScheduledAt != nil {
+				scheduledAt := ride.ScheduledAt.UnixMilli()
+				responseData.ScheduledAt = &scheduledAt
 			}
 
 			if ride.ChairID.Valid {
@@ -779,84 +1399,6 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
-	stats := appGetNotificationResponseChairStats{}
-
-	// latest_status = 'COMPLETED'のものだけを取得
-	rides := []Ride{}
-	err := tx.SelectContext(
-		ctx,
-		&rides,
-		`SELECT *, latest_status FROM rides WHERE chair_id = ? AND latest_status = 'COMPLETED' ORDER BY updated_at DESC`,
-		chairID,
-	)
-	if err != nil {
-		return stats, err
-	}
-
-	if len(rides) == 0 {
-		return stats, nil
-	}
-
-	// ride_idのリストを作成
-	rideIDs := make([]string, len(rides))
-	for i, ride := range rides {
-		rideIDs[i] = ride.ID
-	}
-
-	// IN句を使って一度に全てのride_statusesを取得
-	query, args, err := sqlx.In(`SELECT * FROM ride_statuses WHERE ride_id IN (?) ORDER BY ride_id, created_at`, rideIDs)
-	if err != nil {
-		return stats, err
-	}
-	query = tx.Rebind(query)
-
-	rideStatuses := []RideStatus{}
-	err = tx.SelectContext(ctx, &rideStatuses, query, args...)
-	if err != nil {
-		return stats, err
-	}
-
-	// ride_idごとにride_statusesをグループ化
-	statusMap := make(map[string][]RideStatus)
-	for _, status := range rideStatuses {
-		statusMap[status.RideID] = append(statusMap[status.RideID], status)
-	}
-
-	totalRideCount := 0
-	totalEvaluation := 0.0
-	for _, ride := range rides {
-		statuses, ok := statusMap[ride.ID]
-		if !ok {
-			continue
-		}
-
-		var arrivedAt, pickupedAt *time.Time
-		for _, status := range statuses {
-			if status.Status == "ARRIVED" {
-				arrivedAt = &status.CreatedAt
-			} else if status.Status == "CARRYING" {
-				pickupedAt = &status.CreatedAt
-			}
-		}
-		if arrivedAt == nil || pickupedAt == nil {
-			continue
-		}
-
-		totalRideCount++
-		if ride.Evaluation != nil {
-			totalEvaluation += float64(*ride.Evaluation)
-		}
-	}
-
-	stats.TotalRidesCount = totalRideCount
-	if totalRideCount > 0 {
-		stats.TotalEvaluationAvg = totalEvaluation / float64(totalRideCount)
-	}
-
-	return stats, nil
-}
-
 type appGetNearbyChairsResponse struct {
 	Chairs      []appGetNearbyChairsResponseChair `json:"chairs"`
 	RetrievedAt int64                             `json:"retrieved_at"`
@@ -908,6 +1450,9 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// 相乗りを希望する場合は、相乗りのライドを受け持っていて空きのある椅子も返す
+	pooled := r.URL.Query().Get("pooled") == "true"
+
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
 
 	tx, err := db.Beginx()
@@ -918,6 +1463,7 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// chairsテーブルから椅子情報と最新位置を取得（未完了ライドがないものに絞り込み）
+	// 目的地が分からないので、相乗りできるかどうかは空きの有無だけで判断する
 	chairs := []chairWithLocation{}
 	err = tx.SelectContext(
 		ctx,
@@ -929,12 +1475,17 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 			c.latest_latitude AS latitude,
 			c.latest_longitude AS longitude
 		FROM chairs c
-		LEFT JOIN rides r ON c.id = r.chair_id AND (r.latest_status IS NULL OR r.latest_status != 'COMPLETED')
+		LEFT JOIN rides r ON c.id = r.chair_id AND (r.latest_status IS NULL OR r.latest_status NOT IN ('COMPLETED', 'CANCELED'))
 		WHERE c.is_active = 1
+			AND c.retired_at IS NULL
+			AND c.offline_at IS NULL
+			AND c.deactivated_by_owner = FALSE
 			AND c.latest_latitude IS NOT NULL
 			AND c.latest_longitude IS NOT NULL
 		GROUP BY c.id, c.name, c.model, c.latest_latitude, c.latest_longitude
-		HAVING COUNT(r.id) = 0`,
+		HAVING COUNT(r.id) = 0
+			OR (? AND COUNT(r.id) < ? AND SUM(r.pooled = FALSE OR r.latest_status NOT IN ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING')) = 0)`,
+		pooled, pooledRideCapacity,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -973,19 +1524,29 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+// calculateFare は移動距離から割引前の運賃を求める。移動距離は経由地を含めた全経路のもの
+func calculateFare(distance int) int {
+	meteredFare := farePerDistance * distance
 	return initialFare + meteredFare
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
+// calculateMeteredFare は移動距離に応じた運賃を求める。相乗りのライドは割り引く
+func calculateMeteredFare(distance int, pooled bool) int {
+	meteredFare := farePerDistance * distance
+	if pooled {
+		meteredFare = meteredFare * (100 - pooledRideDiscountPercent) / 100
+	}
+	return meteredFare
+}
+
+// calculateDiscountedFare は相乗りの割引とクーポンを適用した運賃を求める。
+// ride が nil でなければ distance, pooled の代わりにライドの移動距離と相乗りの希望を使う
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, distance int, pooled bool) (int, error) {
 	var coupon Coupon
 	discount := 0
 	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
+		distance = ride.Distance
+		pooled = ride.Pooled
 
 		// すでにクーポンが紐づいているならそれの割引額を参照
 		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
@@ -1015,8 +1576,16 @@ func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ri
 		}
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	meteredFare := calculateMeteredFare(distance, pooled)
 	discountedMeteredFare := max(meteredFare-discount, 0)
 
 	return initialFare + discountedMeteredFare, nil
 }
+
+// chargedFare は決済額が記録されていればそれを、無ければ calculateDiscountedFare と同じ計算で求めた運賃を返す
+func chargedFare(distance int, pooled bool, couponDiscount int, paymentAmount *int) int {
+	if paymentAmount != nil {
+		return *paymentAmount
+	}
+	return initialFare + max(calculateMeteredFare(distance, pooled)-couponDiscount, 0)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// 配車位置に到着したとみなす半径(マンハッタン距離)。0 なら座標が一致した場合だけ到着とする
+	pickupArrivalRadius = envInt("ISUCON_PICKUP_ARRIVAL_RADIUS", 0, 0)
+	// 経由地と目的地に到着したとみなす半径
+	destinationArrivalRadius = envInt("ISUCON_DESTINATION_ARRIVAL_RADIUS", 0, 0)
+)
+
+// 椅子から目的地への到着を伝えられるのは、直前に受け付けた位置が目的地からこの距離(マンハッタン距離)以内にある場合だけ
+var manualArrivalMaxDistance = envInt("ISUCON_MANUAL_ARRIVAL_MAX_DISTANCE", 10, 0)
+
+// 椅子から目的地への到着を伝えられるのは、直前に受け付けた位置がこの時間以内に送られたものである場合だけ
+var manualArrivalMaxLocationAge = envDuration("ISUCON_MANUAL_ARRIVAL_MAX_LOCATION_AGE", 30*time.Second, 0)
+
+// chairLastLocation は椅子から直前に受け付けた位置とその日時
+type chairLastLocation struct {
+	Coordinate
+	At time.Time
+}
+
+// 椅子ごとの直前に受け付けた位置。前回の位置から今回の位置までの間に目的地を通り過ぎたかどうかの判定などに使う
+var (
+	chairLastLocations      = map[string]chairLastLocation{}
+	chairLastLocationsMutex sync.Mutex
+)
+
+// 椅子ごとの位置の受け付けを直列にするロック。前回の位置の読み込みから更新までの間に、同じ椅子の別の位置が割り込まないようにする
+var (
+	chairLocationLocks      = map[string]*sync.Mutex{}
+	chairLocationLocksMutex sync.Mutex
+)
+
+// lockChairLocation は椅子の位置の受け付けをロックし、ロックを解放する関数を返す
+func lockChairLocation(chairID string) func() {
+	chairLocationLocksMutex.Lock()
+	lock, ok := chairLocationLocks[chairID]
+	if !ok {
+		lock = &sync.Mutex{}
+		chairLocationLocks[chairID] = lock
+	}
+	chairLocationLocksMutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// getChairLastLocation は椅子から直前に受け付けた位置を返す。
+// 再起動などでメモリに無ければ、chair_locations から反映された最新の位置を使う。どちらも無ければ nil
+func getChairLastLocation(ctx context.Context, tx sqlx.QueryerContext, chairID string) (*chairLastLocation, error) {
+	chairLastLocationsMutex.Lock()
+	last, ok := chairLastLocations[chairID]
+	chairLastLocationsMutex.Unlock()
+	if ok {
+		return &last, nil
+	}
+
+	chair := &Chair{}
+	if err := sqlx.GetContext(ctx, tx, chair, `SELECT id, latest_latitude, latest_longitude, latest_location_updated_at FROM chairs WHERE id = ?`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return chairLastLocationOf(chair), nil
+}
+
+// chairLastLocationOf は chair_locations から chairs に反映された最新の位置を返す。まだ位置が無ければ nil
+func chairLastLocationOf(chair *Chair) *chairLastLocation {
+	if chair.LatestLatitude == nil || chair.LatestLongitude == nil || chair.LatestLocationUpdatedAt == nil {
+		return nil
+	}
+	return &chairLastLocation{
+		Coordinate: Coordinate{Latitude: *chair.LatestLatitude, Longitude: *chair.LatestLongitude},
+		At:         *chair.LatestLocationUpdatedAt,
+	}
+}
+
+// setChairLastLocation は椅子から受け付けた位置を記録する
+func setChairLastLocation(chairID string, location chairLastLocation) {
+	chairLastLocationsMutex.Lock()
+	chairLastLocations[chairID] = location
+	chairLastLocationsMutex.Unlock()
+}
+
+// 椅子が迎車中か乗車中のライドと、まだ立ち寄っていない最初の経由地
+const movingRidesOfChairQuery = `SELECT r.*, r.latest_status, w.latitude AS next_waypoint_latitude, w.longitude AS next_waypoint_longitude
+ FROM rides r
+ LEFT JOIN ride_waypoints w ON w.ride_id = r.id AND w.seq = (SELECT MIN(seq) FROM ride_waypoints WHERE ride_id = r.id AND reached_at IS NULL)
+ WHERE r.chair_id = ? AND r.latest_status IN ('ENROUTE', 'CARRYING')`
+
+// rideWithNextWaypoint はライドと、まだ立ち寄っていない最初の経由地。経由地が残っていなければ nil
+type rideWithNextWaypoint struct {
+	Ride
+	NextWaypointLatitude  *int `db:"next_waypoint_latitude"`
+	NextWaypointLongitude *int `db:"next_waypoint_longitude"`
+}
+
+// reachedNextRideTarget は椅子がライドの次の目標に到着したかどうか、つまりライドのステータスを更新する必要があるかどうかを返す。
+// 次の目標は、迎車中なら配車位置、乗車中なら残っている最初の経由地か目的地
+func reachedNextRideTarget(ride *rideWithNextWaypoint, previous *Coordinate, current Coordinate) bool {
+	switch ride.LatestStatus.String {
+	case "ENROUTE":
+		return reachedTarget(previous, current, Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}, pickupArrivalRadius)
+	case "CARRYING":
+		if ride.NextWaypointLatitude != nil && ride.NextWaypointLongitude != nil {
+			return reachedTarget(previous, current, Coordinate{Latitude: *ride.NextWaypointLatitude, Longitude: *ride.NextWaypointLongitude}, destinationArrivalRadius)
+		}
+		return reachedTarget(previous, current, Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}, destinationArrivalRadius)
+	}
+	return false
+}
+
+// reachedTarget は椅子が target に到着したかどうかを判定する。
+// 今回の位置が target から radius 以内にあるか、前回の位置から今回の位置まで直進したとみなした線分が target から radius 以内を通っていれば到着とする
+func reachedTarget(previous *Coordinate, current, target Coordinate, radius int) bool {
+	if calculateDistance(current.Latitude, current.Longitude, target.Latitude, target.Longitude) <= radius {
+		return true
+	}
+	if previous == nil {
+		return false
+	}
+	// 線分上の点は座標が整数とは限らないので、誤差を見込んで比べる
+	return distanceToSegment(*previous, current, target) <= float64(radius)+1e-9
+}
+
+// distanceToSegment は from から to への線分と point との最短のマンハッタン距離を返す
+func distanceToSegment(from, to, point Coordinate) float64 {
+	dLat := float64(to.Latitude - from.Latitude)
+	dLon := float64(to.Longitude - from.Longitude)
+	// 線分上の位置 t (0〜1) に対する距離は下に凸な折れ線なので、端点と、緯度・経度のどちらかが point と揃う位置だけを調べればよい
+	ts := []float64{0, 1}
+	if dLat != 0 {
+		ts = append(ts, float64(point.Latitude-from.Latitude)/dLat)
+	}
+	if dLon != 0 {
+		ts = append(ts, float64(point.Longitude-from.Longitude)/dLon)
+	}
+	shortest := math.Inf(1)
+	for _, t := range ts {
+		t = min(max(t, 0), 1)
+		d := math.Abs(float64(from.Latitude)+dLat*t-float64(point.Latitude)) +
+			math.Abs(float64(from.Longitude)+dLon*t-float64(point.Longitude))
+		shortest = min(shortest, d)
+	}
+	return shortest
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestReachedTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous *Coordinate
+		current  Coordinate
+		target   Coordinate
+		radius   int
+		want     bool
+	}{
+		{name: "exact", current: Coordinate{10, 10}, target: Coordinate{10, 10}, radius: 0, want: true},
+		{name: "radius 0 off by one", current: Coordinate{10, 11}, target: Coordinate{10, 10}, radius: 0, want: false},
+		{name: "overshoot by one within radius", current: Coordinate{10, 11}, target: Coordinate{10, 10}, radius: 1, want: true},
+		{name: "overshoot by two outside radius", current: Coordinate{10, 12}, target: Coordinate{10, 10}, radius: 1, want: false},
+		{name: "passed through straight", previous: &Coordinate{10, 0}, current: Coordinate{10, 20}, target: Coordinate{10, 10}, radius: 0, want: true},
+		{name: "passed through diagonal", previous: &Coordinate{0, 0}, current: Coordinate{10, 10}, target: Coordinate{5, 5}, radius: 0, want: true},
+		{name: "inside box but off route", previous: &Coordinate{0, 0}, current: Coordinate{10, 10}, target: Coordinate{10, 0}, radius: 0, want: false},
+		{name: "inside box near route within radius", previous: &Coordinate{0, 0}, current: Coordinate{10, 10}, target: Coordinate{6, 5}, radius: 1, want: true},
+		{name: "inside box near route outside radius", previous: &Coordinate{0, 0}, current: Coordinate{10, 10}, target: Coordinate{8, 2}, radius: 1, want: false},
+		{name: "before the segment", previous: &Coordinate{10, 5}, current: Coordinate{10, 20}, target: Coordinate{10, 0}, radius: 0, want: false},
+		{name: "no previous location", current: Coordinate{10, 20}, target: Coordinate{10, 10}, radius: 0, want: false},
+		{name: "not moved", previous: &Coordinate{10, 20}, current: Coordinate{10, 20}, target: Coordinate{10, 10}, radius: 0, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reachedTarget(tt.previous, tt.current, tt.target, tt.radius); got != tt.want {
+				t.Errorf("reachedTarget() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReachedNextRideTarget(t *testing.T) {
+	ride := func(status string, waypoint *Coordinate) *rideWithNextWaypoint {
+		r := &rideWithNextWaypoint{Ride: Ride{
+			PickupLatitude:       0,
+			PickupLongitude:      10,
+			DestinationLatitude:  20,
+			DestinationLongitude: 20,
+			LatestStatus:         sql.NullString{String: status, Valid: true},
+		}}
+		if waypoint != nil {
+			r.NextWaypointLatitude = &waypoint.Latitude
+			r.NextWaypointLongitude = &waypoint.Longitude
+		}
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		ride    *rideWithNextWaypoint
+		current Coordinate
+		want    bool
+	}{
+		{name: "enroute at pickup", ride: ride("ENROUTE", nil), current: Coordinate{0, 10}, want: true},
+		{name: "enroute elsewhere", ride: ride("ENROUTE", nil), current: Coordinate{20, 20}, want: false},
+		{name: "carrying at destination", ride: ride("CARRYING", nil), current: Coordinate{20, 20}, want: true},
+		{name: "carrying at next waypoint", ride: ride("CARRYING", &Coordinate{5, 5}), current: Coordinate{5, 5}, want: true},
+		{name: "carrying at destination before waypoint", ride: ride("CARRYING", &Coordinate{5, 5}), current: Coordinate{20, 20}, want: false},
+		{name: "pickup while carrying", ride: ride("CARRYING", nil), current: Coordinate{0, 10}, want: false},
+		{name: "matching", ride: ride("MATCHING", nil), current: Coordinate{0, 10}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reachedNextRideTarget(tt.ride, nil, tt.current); got != tt.want {
+				t.Errorf("reachedNextRideTarget() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetChairLastLocationFromMemory(t *testing.T) {
+	at := time.Now()
+	setChairLastLocation("chair-in-memory", chairLastLocation{Coordinate: Coordinate{Latitude: 1, Longitude: 2}, At: at})
+	t.Cleanup(func() {
+		chairLastLocationsMutex.Lock()
+		delete(chairLastLocations, "chair-in-memory")
+		chairLastLocationsMutex.Unlock()
+	})
+
+	// メモリにあればDBは読まない
+	got, err := getChairLastLocation(context.Background(), nil, "chair-in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Coordinate != (Coordinate{Latitude: 1, Longitude: 2}) || !got.At.Equal(at) {
+		t.Errorf("getChairLastLocation() = %+v, want the location in memory", got)
+	}
+}
+
+func TestChairLastLocationOf(t *testing.T) {
+	at := time.Now()
+	tests := []struct {
+		name  string
+		chair *Chair
+		want  *chairLastLocation
+	}{
+		{name: "no location yet", chair: &Chair{}, want: nil},
+		{name: "no updated time", chair: &Chair{LatestLatitude: ptr(1), LatestLongitude: ptr(2)}, want: nil},
+		{
+			name:  "latest location",
+			chair: &Chair{LatestLatitude: ptr(1), LatestLongitude: ptr(2), LatestLocationUpdatedAt: &at},
+			want:  &chairLastLocation{Coordinate: Coordinate{Latitude: 1, Longitude: 2}, At: at},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chairLastLocationOf(tt.chair)
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("chairLastLocationOf() = %+v, want %+v", got, tt.want)
+			}
+			if got != nil && (got.Coordinate != tt.want.Coordinate || !got.At.Equal(tt.want.At)) {
+				t.Errorf("chairLastLocationOf() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
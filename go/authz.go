@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 認証主体とリソースの関係
+type resourceRelation string
+
+const (
+	// ライドを依頼した利用者
+	relationRider resourceRelation = "RIDER"
+	// ライドに割り当てられた椅子
+	relationAssignedChair resourceRelation = "ASSIGNED_CHAIR"
+	// ライドに割り当てられた椅子、または椅子や椅子登録トークンを所有するオーナー
+	relationOwner resourceRelation = "OWNER"
+	// 椅子自身
+	relationSelf resourceRelation = "SELF"
+)
+
+type resourceAction string
+
+const (
+	actionRideRead                 resourceAction = "ride:read"
+	actionRideEvaluate             resourceAction = "ride:evaluate"
+	actionRideCancel               resourceAction = "ride:cancel"
+	actionRideUpdateStatus         resourceAction = "ride:update_status"
+	actionRideRefund               resourceAction = "ride:refund"
+	actionRideRateRider            resourceAction = "ride:rate_rider"
+	actionChairRead                resourceAction = "chair:read"
+	actionChairUpdate              resourceAction = "chair:update"
+	actionChairRetire              resourceAction = "chair:retire"
+	actionChairRegisterTokenManage resourceAction = "chair_register_token:manage"
+)
+
+// authorizationPolicy は操作ごとに、それを許可する認証主体とリソースの関係を定める。
+// リソースが存在しないか認証主体と無関係なら存在を明かさないよう 404 を、
+// 関係はあるがその関係では許可されていない操作なら 403 を返す。
+// 認証を通らない /api/internal のルートはここでは扱わない
+var authorizationPolicy = map[resourceAction][]resourceRelation{
+	actionRideRead:                 {relationRider, relationAssignedChair, relationOwner},
+	actionRideEvaluate:             {relationRider},
+	actionRideCancel:               {relationRider},
+	actionRideUpdateStatus:         {relationAssignedChair},
+	actionRideRefund:               {relationOwner},
+	actionRideRateRider:            {relationAssignedChair},
+	actionChairRead:                {relationOwner, relationSelf},
+	actionChairUpdate:              {relationOwner},
+	actionChairRetire:              {relationOwner},
+	actionChairRegisterTokenManage: {relationOwner},
+}
+
+// requestPrincipal は認証ミドルウェアが context に入れた認証主体の種類とIDを返す
+func requestPrincipal(ctx context.Context) (string, string) {
+	if user, ok := ctx.Value("user").(*User); ok {
+		return sessionRoleApp, user.ID
+	}
+	if owner, ok := ctx.Value("owner").(*Owner); ok {
+		return sessionRoleOwner, owner.ID
+	}
+	if chair, ok := ctx.Value("chair").(*Chair); ok {
+		return sessionRoleChair, chair.ID
+	}
+	return "", ""
+}
+
+// authorize は認証主体とリソースの関係が action を許可されているか判定する。
+// 失敗した場合はレスポンスに使うステータスコードとエラーを返す
+func authorize(relation resourceRelation, action resourceAction, notFound error) (int, error) {
+	if relation == "" {
+		return http.StatusNotFound, notFound
+	}
+	if !slices.Contains(authorizationPolicy[action], relation) {
+		return http.StatusForbidden, fmt.Errorf("not allowed to %s", action)
+	}
+	return 0, nil
+}
+
+// rideRelation は認証主体とライドの関係を返す。無関係なら空文字列を返す。
+// chairOwnerID はライドに割り当てられた椅子のオーナーのIDで、認証主体がオーナーの場合だけ使う
+func rideRelation(role, principalID string, ride *Ride, chairOwnerID string) resourceRelation {
+	switch role {
+	case sessionRoleApp:
+		if ride.UserID == principalID {
+			return relationRider
+		}
+	case sessionRoleChair:
+		if ride.ChairID.Valid && ride.ChairID.String == principalID {
+			return relationAssignedChair
+		}
+	case sessionRoleOwner:
+		if ride.ChairID.Valid && chairOwnerID == principalID {
+			return relationOwner
+		}
+	}
+	return ""
+}
+
+// chairRelation は認証主体と椅子の関係を返す。無関係なら空文字列を返す
+func chairRelation(role, principalID string, chair *Chair) resourceRelation {
+	switch role {
+	case sessionRoleOwner:
+		if chair.OwnerID == principalID {
+			return relationOwner
+		}
+	case sessionRoleChair:
+		if chair.ID == principalID {
+			return relationSelf
+		}
+	}
+	return ""
+}
+
+// chairRegisterTokenRelation は認証主体と椅子登録トークンの関係を返す。無関係なら空文字列を返す
+func chairRegisterTokenRelation(role, principalID string, token *ChairRegisterToken) resourceRelation {
+	if role == sessionRoleOwner && token.OwnerID == principalID {
+		return relationOwner
+	}
+	return ""
+}
+
+var (
+	errRideNotFound               = errors.New("ride not found")
+	errChairNotFound              = errors.New("chair not found")
+	errChairRegisterTokenNotFound = errors.New("chair register token not found")
+)
+
+// authorizeRide はライドを取得し、リクエストの認証主体が action を行えるか確認する。
+// forUpdate ならライドの行をロックする
+func authorizeRide(ctx context.Context, tx *sqlx.Tx, rideID string, action resourceAction, forUpdate bool) (*Ride, int, error) {
+	query := `SELECT *, latest_status, scheduled_at, distance, pooled FROM rides WHERE id = ?`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, query, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusNotFound, errRideNotFound
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	role, principalID := requestPrincipal(ctx)
+	chairOwnerID := ""
+	if role == sessionRoleOwner && ride.ChairID.Valid {
+		if err := tx.GetContext(ctx, &chairOwnerID, `SELECT owner_id FROM chairs WHERE id = ?`, ride.ChairID.String); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+	relation := rideRelation(role, principalID, ride, chairOwnerID)
+
+	if status, err := authorize(relation, action, errRideNotFound); err != nil {
+		return nil, status, err
+	}
+	return ride, 0, nil
+}
+
+// authorizeChair は椅子を取得し、リクエストの認証主体が action を行えるか確認する。
+// forUpdate なら椅子の行をロックする
+func authorizeChair(ctx context.Context, tx *sqlx.Tx, chairID string, action resourceAction, forUpdate bool) (*Chair, int, error) {
+	query := `SELECT *, latest_latitude, latest_longitude, latest_location_updated_at, total_distance, total_distance_updated_at, retired_at, offline_at, deactivated_by_owner FROM chairs WHERE id = ?`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, query, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusNotFound, errChairNotFound
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	role, principalID := requestPrincipal(ctx)
+	relation := chairRelation(role, principalID, chair)
+
+	if status, err := authorize(relation, action, errChairNotFound); err != nil {
+		return nil, status, err
+	}
+	return chair, 0, nil
+}
+
+// authorizeChairRegisterToken は椅子登録トークンを取得し、リクエストの認証主体が action を行えるか確認する。
+// forUpdate ならトークンの行をロックする
+func authorizeChairRegisterToken(ctx context.Context, tx *sqlx.Tx, tokenID string, action resourceAction, forUpdate bool) (*ChairRegisterToken, int, error) {
+	query := `SELECT * FROM chair_register_tokens WHERE id = ?`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	token := &ChairRegisterToken{}
+	if err := tx.GetContext(ctx, token, query, tokenID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusNotFound, errChairRegisterTokenNotFound
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	role, principalID := requestPrincipal(ctx)
+	relation := chairRegisterTokenRelation(role, principalID, token)
+
+	if status, err := authorize(relation, action, errChairRegisterTokenNotFound); err != nil {
+		return nil, status, err
+	}
+	return token, 0, nil
+}
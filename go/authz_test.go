@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+)
+
+// 認可の判定に使う認証主体。ライド・椅子・椅子登録トークンはどれも user1, chair1, owner1 に関係する
+var (
+	testRider      = &User{ID: "user1"}
+	testOtherUser  = &User{ID: "user2"}
+	testChair      = &Chair{ID: "chair1", OwnerID: "owner1"}
+	testOtherChair = &Chair{ID: "chair2", OwnerID: "owner2"}
+	testOwner      = &Owner{ID: "owner1"}
+	testOtherOwner = &Owner{ID: "owner2"}
+)
+
+func principalContext(principal any) context.Context {
+	ctx := context.Background()
+	switch p := principal.(type) {
+	case *User:
+		return context.WithValue(ctx, "user", p)
+	case *Owner:
+		return context.WithValue(ctx, "owner", p)
+	case *Chair:
+		return context.WithValue(ctx, "chair", p)
+	}
+	return ctx
+}
+
+func TestAuthorizeRide(t *testing.T) {
+	assigned := &Ride{ID: "ride1", UserID: "user1", ChairID: sql.NullString{String: "chair1", Valid: true}}
+	unassigned := &Ride{ID: "ride2", UserID: "user1"}
+
+	tests := []struct {
+		name      string
+		ride      *Ride
+		principal any
+		// ライドに割り当てられた椅子のオーナー
+		chairOwnerID string
+		want         map[resourceAction]int
+	}{
+		{
+			name:      "rider",
+			ride:      assigned,
+			principal: testRider,
+			want: map[resourceAction]int{
+				actionRideRead:         0,
+				actionRideEvaluate:     0,
+				actionRideCancel:       0,
+				actionRideUpdateStatus: http.StatusForbidden,
+				actionRideRefund:       http.StatusForbidden,
+				actionRideRateRider:    http.StatusForbidden,
+			},
+		},
+		{
+			name:      "other user",
+			ride:      assigned,
+			principal: testOtherUser,
+			want: map[resourceAction]int{
+				actionRideRead:         http.StatusNotFound,
+				actionRideEvaluate:     http.StatusNotFound,
+				actionRideCancel:       http.StatusNotFound,
+				actionRideUpdateStatus: http.StatusNotFound,
+				actionRideRefund:       http.StatusNotFound,
+				actionRideRateRider:    http.StatusNotFound,
+			},
+		},
+		{
+			name:      "assigned chair",
+			ride:      assigned,
+			principal: testChair,
+			want: map[resourceAction]int{
+				actionRideRead:         0,
+				actionRideEvaluate:     http.StatusForbidden,
+				actionRideCancel:       http.StatusForbidden,
+				actionRideUpdateStatus: 0,
+				actionRideRefund:       http.StatusForbidden,
+				actionRideRateRider:    0,
+			},
+		},
+		{
+			name:      "other chair",
+			ride:      assigned,
+			principal: testOtherChair,
+			want: map[resourceAction]int{
+				actionRideRead:         http.StatusNotFound,
+				actionRideEvaluate:     http.StatusNotFound,
+				actionRideCancel:       http.StatusNotFound,
+				actionRideUpdateStatus: http.StatusNotFound,
+				actionRideRefund:       http.StatusNotFound,
+				actionRideRateRider:    http.StatusNotFound,
+			},
+		},
+		{
+			name:         "owner of assigned chair",
+			ride:         assigned,
+			principal:    testOwner,
+			chairOwnerID: "owner1",
+			want: map[resourceAction]int{
+				actionRideRead:         0,
+				actionRideEvaluate:     http.StatusForbidden,
+				actionRideCancel:       http.StatusForbidden,
+				actionRideUpdateStatus: http.StatusForbidden,
+				actionRideRefund:       0,
+				actionRideRateRider:    http.StatusForbidden,
+			},
+		},
+		{
+			name:         "other owner",
+			ride:         assigned,
+			principal:    testOtherOwner,
+			chairOwnerID: "owner1",
+			want: map[resourceAction]int{
+				actionRideRead:         http.StatusNotFound,
+				actionRideEvaluate:     http.StatusNotFound,
+				actionRideCancel:       http.StatusNotFound,
+				actionRideUpdateStatus: http.StatusNotFound,
+				actionRideRefund:       http.StatusNotFound,
+				actionRideRateRider:    http.StatusNotFound,
+			},
+		},
+		{
+			name:      "chair on unassigned ride",
+			ride:      unassigned,
+			principal: testChair,
+			want: map[resourceAction]int{
+				actionRideRead:         http.StatusNotFound,
+				actionRideUpdateStatus: http.StatusNotFound,
+				actionRideRateRider:    http.StatusNotFound,
+			},
+		},
+		{
+			name:         "owner on unassigned ride",
+			ride:         unassigned,
+			principal:    testOwner,
+			chairOwnerID: "owner1",
+			want: map[resourceAction]int{
+				actionRideRead:   http.StatusNotFound,
+				actionRideRefund: http.StatusNotFound,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, principalID := requestPrincipal(principalContext(tt.principal))
+			relation := rideRelation(role, principalID, tt.ride, tt.chairOwnerID)
+			for action, want := range tt.want {
+				status, err := authorize(relation, action, errRideNotFound)
+				if status != want {
+					t.Errorf("%s: status = %d, want %d (err = %v)", action, status, want, err)
+				}
+				if want == http.StatusNotFound && err != errRideNotFound {
+					t.Errorf("%s: err = %v, want %v", action, err, errRideNotFound)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizeChair(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal any
+		want      map[resourceAction]int
+	}{
+		{
+			name:      "owner",
+			principal: testOwner,
+			want: map[resourceAction]int{
+				actionChairRead:   0,
+				actionChairUpdate: 0,
+				actionChairRetire: 0,
+			},
+		},
+		{
+			name:      "other owner",
+			principal: testOtherOwner,
+			want: map[resourceAction]int{
+				actionChairRead:   http.StatusNotFound,
+				actionChairUpdate: http.StatusNotFound,
+				actionChairRetire: http.StatusNotFound,
+			},
+		},
+		{
+			name:      "chair itself",
+			principal: testChair,
+			want: map[resourceAction]int{
+				actionChairRead:   0,
+				actionChairUpdate: http.StatusForbidden,
+				actionChairRetire: http.StatusForbidden,
+			},
+		},
+		{
+			name:      "other chair",
+			principal: testOtherChair,
+			want: map[resourceAction]int{
+				actionChairRead:   http.StatusNotFound,
+				actionChairUpdate: http.StatusNotFound,
+				actionChairRetire: http.StatusNotFound,
+			},
+		},
+		{
+			name:      "rider",
+			principal: testRider,
+			want: map[resourceAction]int{
+				actionChairRead:   http.StatusNotFound,
+				actionChairUpdate: http.StatusNotFound,
+				actionChairRetire: http.StatusNotFound,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, principalID := requestPrincipal(principalContext(tt.principal))
+			relation := chairRelation(role, principalID, testChair)
+			for action, want := range tt.want {
+				status, err := authorize(relation, action, errChairNotFound)
+				if status != want {
+					t.Errorf("%s: status = %d, want %d (err = %v)", action, status, want, err)
+				}
+				if want == http.StatusNotFound && err != errChairNotFound {
+					t.Errorf("%s: err = %v, want %v", action, err, errChairNotFound)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizeChairRegisterToken(t *testing.T) {
+	token := &ChairRegisterToken{ID: "token1", OwnerID: "owner1"}
+
+	tests := []struct {
+		name      string
+		principal any
+		want      int
+	}{
+		{name: "owner", principal: testOwner, want: 0},
+		{name: "other owner", principal: testOtherOwner, want: http.StatusNotFound},
+		{name: "chair of owner", principal: testChair, want: http.StatusNotFound},
+		{name: "rider", principal: testRider, want: http.StatusNotFound},
+		{name: "no principal", principal: nil, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, principalID := requestPrincipal(principalContext(tt.principal))
+			relation := chairRegisterTokenRelation(role, principalID, token)
+			status, err := authorize(relation, actionChairRegisterTokenManage, errChairRegisterTokenNotFound)
+			if status != tt.want {
+				t.Errorf("status = %d, want %d (err = %v)", status, tt.want, err)
+			}
+		})
+	}
+}
+
+// 認可の表に操作を足したら、上のテストにも足すこと
+func TestAuthorizationPolicyCovered(t *testing.T) {
+	tested := []resourceAction{
+		actionRideRead,
+		actionRideEvaluate,
+		actionRideCancel,
+		actionRideUpdateStatus,
+		actionRideRefund,
+		actionRideRateRider,
+		actionChairRead,
+		actionChairUpdate,
+		actionChairRetire,
+		actionChairRegisterTokenManage,
+	}
+	if len(authorizationPolicy) != len(tested) {
+		t.Fatalf("authorizationPolicy has %d actions, but %d are tested", len(authorizationPolicy), len(tested))
+	}
+	for _, action := range tested {
+		if _, ok := authorizationPolicy[action]; !ok {
+			t.Errorf("%s is not in authorizationPolicy", action)
+		}
+	}
+}
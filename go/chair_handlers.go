@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -34,8 +39,19 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
+	chairID := ulid.Make().String()
+	accessToken := secureRandomStr(32)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 登録回数の上限を超えないよう、使用回数を数え終わるまでトークンの行をロックする
+	registerToken := &ChairRegisterToken{}
+	if err := tx.GetContext(ctx, registerToken, "SELECT * FROM chair_register_tokens WHERE token = ? FOR UPDATE", hashToken(req.ChairRegisterToken)); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
 			return
@@ -43,32 +59,53 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if !registerToken.available(time.Now()) {
+		writeError(w, http.StatusUnauthorized, errors.New("chair_register_token is revoked, expired or used up"))
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chair_register_tokens SET used_count = used_count + 1 WHERE id = ?", registerToken.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	chairID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
-
-	_, err := db.ExecContext(
+	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
-		chairID, owner.ID, req.Name, req.Model, false, accessToken,
+		"INSERT INTO chairs (id, owner_id, name, model, is_active) VALUES (?, ?, ?, ?, ?)",
+		chairID, registerToken.OwnerID, req.Name, req.Model, false,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "chair_session",
-		Value: accessToken,
-	})
+	expiresAt, err := createSession(ctx, tx, sessionRoleChair, chairID, accessToken)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	setSessionCookie(w, sessionRoleChair, accessToken, expiresAt)
 
 	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
 		ID:      chairID,
-		OwnerID: owner.ID,
+		OwnerID: registerToken.OwnerID,
 	})
 }
 
+func chairPostLogout(w http.ResponseWriter, r *http.Request) {
+	postSessionLogout(w, r, sessionRoleChair)
+}
+
+func chairPostRotateToken(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+	postSessionRotate(w, r, sessionRoleChair, chair.ID)
+}
+
 type postChairActivityRequest struct {
 	IsActive bool `json:"is_active"`
 }
@@ -83,15 +120,51 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	tx, err := db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
+
+	// オーナーが強制的に配車受付停止にしている間は、椅子からは再開できない
+	deactivatedByOwner := false
+	if err := tx.GetContext(ctx, &deactivatedByOwner, `SELECT deactivated_by_owner FROM chairs WHERE id = ? FOR UPDATE`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if req.IsActive && deactivatedByOwner {
+		writeError(w, http.StatusForbidden, errors.New("chair is deactivated by owner"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordChairActivity(ctx, tx, chair.ID, req.IsActive); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// recordChairActivity は配車受付状態の変更履歴を記録する。稼働率の計算に使う
+func recordChairActivity(ctx context.Context, tx sqlx.ExecerContext, chairID string, isActive bool) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_activities (id, chair_id, is_active, created_at) VALUES (?, ?, ?, ?)`,
+		ulid.Make().String(), chairID, isActive, time.Now(),
+	)
+	return err
+}
+
 type chairPostCoordinateResponse struct {
 	RecordedAt int64 `json:"recorded_at"`
 }
@@ -105,71 +178,159 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	chair := ctx.Value("chair").(*Chair)
-
-	// chair_locationをバッファに追加
-	chairLocationID := ulid.Make().String()
 	now := time.Now()
-	location := ChairLocation{
-		ID:        chairLocationID,
-		ChairID:   chair.ID,
-		Latitude:  req.Latitude,
-		Longitude: req.Longitude,
-		CreatedAt: now,
+
+	if err := touchChairLiveness(ctx, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	chairLocationBufferMutex.Lock()
-	chairLocationBuffer = append(chairLocationBuffer, location)
-	chairLocationBufferMutex.Unlock()
+	// 同じ椅子から続けて届いた位置は、前回の位置の読み込みから記録までを1つずつ行う
+	unlock := lockChairLocation(chair.ID)
+	defer unlock()
 
-	// ride_statusesの更新のみトランザクション処理
-	tx, err := db.Beginx()
+	// 前回の位置から椅子の速度では移動できない位置なら異常として記録する
+	previous, err := getChairLastLocation(ctx, db, chair.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
-
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT *, latest_status FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
+	speed, err := getChairModelSpeed(ctx, chair.Model)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if anomaly := checkChairLocationAnomaly(chair, speed, previous, *req, now); anomaly != nil {
+		// 異常な位置は記録だけして、移動距離や到着の判定、次の位置の検証には使わない
+		if err := recordChairLocationAnomaly(ctx, db, anomaly); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-	} else {
-		status := ""
-		if ride.LatestStatus.Valid {
-			status = ride.LatestStatus.String
+		if anomaly.Rejected {
+			writeError(w, http.StatusBadRequest, errors.New("coordinate is too far from the previous one"))
+			return
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
+		writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
+			RecordedAt: now.UnixMilli(),
+		})
+		return
+	}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
+	// 相乗りでは複数のライドを同時に受け持つので、迎車中・乗車中のライドそれぞれについて到着を判定する。
+	// ほとんどの位置ではどのライドも次の目標に着いていないので、着いたライドがあるときだけトランザクションを始める
+	rides := []rideWithNextWaypoint{}
+	if err := db.SelectContext(ctx, &rides, movingRidesOfChairQuery, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var previousCoordinate *Coordinate
+	if previous != nil {
+		previousCoordinate = &previous.Coordinate
+	}
+	reachedRideIDs := []string{}
+	for i := range rides {
+		if reachedNextRideTarget(&rides[i], previousCoordinate, *req) {
+			reachedRideIDs = append(reachedRideIDs, rides[i].ID)
+		}
+	}
+	if len(reachedRideIDs) > 0 {
+		tx, err := db.Beginx()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		for _, rideID := range reachedRideIDs {
+			// 読み込んでから椅子がステータスを変えているかもしれないので、ロックして読み直す
+			ride := &Ride{}
+			if err := tx.GetContext(ctx, ride, `SELECT *, latest_status FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := updateRideStatusByCoordinate(ctx, tx, ride, previousCoordinate, *req, now); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
 			}
 		}
+
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	setChairLastLocation(chair.ID, chairLastLocation{Coordinate: *req, At: now})
+
+	// chair_locationをバッファに追加
+	chairLocationID := ulid.Make().String()
+	location := ChairLocation{
+		ID:        chairLocationID,
+		ChairID:   chair.ID,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		CreatedAt: now,
 	}
 
+	chairLocationBufferMutex.Lock()
+	chairLocationBuffer = append(chairLocationBuffer, location)
+	chairLocationBufferMutex.Unlock()
+
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
 		RecordedAt: now.UnixMilli(),
 	})
 }
 
+// updateRideStatusByCoordinate は椅子が配車位置や経由地、目的地に到着していればライドの状態を進める。
+// previous は椅子の前回の位置で、分からなければ nil
+func updateRideStatusByCoordinate(ctx context.Context, tx *sqlx.Tx, ride *Ride, previous *Coordinate, current Coordinate, now time.Time) error {
+	status := ""
+	if ride.LatestStatus.Valid {
+		status = ride.LatestStatus.String
+	}
+
+	if status == "ENROUTE" && reachedTarget(previous, current, Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}, pickupArrivalRadius) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
+			return err
+		}
+	}
+
+	if status != "CARRYING" {
+		return nil
+	}
+	// 経由地には順番に立ち寄り、全て立ち寄ってから目的地に到着する。
+	// 1回の間に複数を通り過ぎることもあるので、到着した経由地から今回の位置までの間で次を判定する
+	waypoints := []RideWaypoint{}
+	if err := tx.SelectContext(ctx, &waypoints, `SELECT * FROM ride_waypoints WHERE ride_id = ? AND reached_at IS NULL ORDER BY seq`, ride.ID); err != nil {
+		return err
+	}
+	for _, waypoint := range waypoints {
+		target := Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude}
+		if !reachedTarget(previous, current, target, destinationArrivalRadius) {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE ride_waypoints SET reached_at = ? WHERE ride_id = ? AND seq = ?", now, ride.ID, waypoint.Seq); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status, waypoint_seq) VALUES (?, ?, ?, ?)", ulid.Make().String(), ride.ID, "WAYPOINT", waypoint.Seq); err != nil {
+			return err
+		}
+		previous = &target
+	}
+	if reachedTarget(previous, current, Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}, destinationArrivalRadius) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type simpleUser struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
+	// 椅子からの評価の平均。まだ評価されていなければ null
+	Rating      *float64 `json:"rating"`
+	RatingCount int      `json:"rating_count"`
 }
 
 type chairGetNotificationResponse struct {
@@ -183,6 +344,13 @@ type chairGetNotificationResponseData struct {
 	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate `json:"destination_coordinate"`
 	Status                string     `json:"status"`
+	ScheduledAt           *int64     `json:"scheduled_at,omitempty"`
+	// 配車位置から目的地までに順に立ち寄る経由地
+	Stops []rideStop `json:"stops"`
+	// 到着した経由地の順番。status が WAYPOINT の場合のみ
+	WaypointIndex *int `json:"waypoint_index,omitempty"`
+	// 相乗りのライドかどうか。相乗りでは複数のライドの通知が届く
+	Pooled bool `json:"pooled"`
 }
 
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
@@ -222,7 +390,7 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		}
 
 		ride := &Ride{}
-		if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+		if err := tx.GetContext(ctx, ride, `SELECT *, scheduled_at, pooled FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 			tx.Rollback()
 			if errors.Is(err, sql.ErrNoRows) {
 				return
@@ -230,60 +398,93 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// 未送信の状態を取得
-		yetSentRideStatuses := []RideStatus{}
-		if err := tx.SelectContext(ctx, &yetSentRideStatuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC`, ride.ID); err != nil {
+		// 相乗りで同時に受け持っている他のライドの未送信の状態も送る
+		rides := []Ride{*ride}
+		pooledRides := []Ride{}
+		if err := tx.SelectContext(
+			ctx,
+			&pooledRides,
+			`SELECT *, scheduled_at, pooled FROM rides r
+			 WHERE r.chair_id = ? AND r.pooled = TRUE AND r.id <> ?
+			 AND EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.chair_sent_at IS NULL)
+			 ORDER BY r.updated_at`,
+			chair.ID, ride.ID,
+		); err != nil {
 			tx.Rollback()
 			return
 		}
+		rides = append(rides, pooledRides...)
 
-		// 未送信の状態がない場合はスキップ
-		if len(yetSentRideStatuses) == 0 {
-			tx.Rollback()
-			return
-		}
-
-		user := &User{}
-		err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
-		if err != nil {
-			tx.Rollback()
-			return
-		}
+		for _, ride := range rides {
+			// 未送信の状態を取得
+			yetSentRideStatuses := []RideStatus{}
+			if err := tx.SelectContext(ctx, &yetSentRideStatuses, `SELECT *, waypoint_seq FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC`, ride.ID); err != nil {
+				tx.Rollback()
+				return
+			}
 
-		// 各未送信状態を順次送信
-		for _, rideStatus := range yetSentRideStatuses {
-			responseData := &chairGetNotificationResponseData{
-				RideID: ride.ID,
-				User: simpleUser{
-					ID:   user.ID,
-					Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-				},
-				PickupCoordinate: Coordinate{
-					Latitude:  ride.PickupLatitude,
-					Longitude: ride.PickupLongitude,
-				},
-				DestinationCoordinate: Coordinate{
-					Latitude:  ride.DestinationLatitude,
-					Longitude: ride.DestinationLongitude,
-				},
-				Status: rideStatus.Status,
+			// 未送信の状態がない場合はスキップ
+			if len(yetSentRideStatuses) == 0 {
+				continue
 			}
 
-			// SSE形式で送信
-			data, err := json.Marshal(responseData)
+			user := &User{}
+			err = tx.GetContext(ctx, user, "SELECT *, rating_count, rating_sum FROM users WHERE id = ? FOR SHARE", ride.UserID)
 			if err != nil {
 				tx.Rollback()
 				return
 			}
-			fmt.Fprintf(w, "data:%s\n\n", data)
-			flusher.Flush()
 
-			// 送信済みマーク
-			_, err = tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, rideStatus.ID)
+			waypoints, err := getRideWaypoints(ctx, tx, ride.ID)
 			if err != nil {
 				tx.Rollback()
 				return
 			}
+
+			// 各未送信状態を順次送信
+			for _, rideStatus := range yetSentRideStatuses {
+				responseData := &chairGetNotificationResponseData{
+					RideID: ride.ID,
+					User: simpleUser{
+						ID:          user.ID,
+						Name:        fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+						Rating:      user.ratingAvg(),
+						RatingCount: user.RatingCount,
+					},
+					PickupCoordinate: Coordinate{
+						Latitude:  ride.PickupLatitude,
+						Longitude: ride.PickupLongitude,
+					},
+					DestinationCoordinate: Coordinate{
+						Latitude:  ride.DestinationLatitude,
+						Longitude: ride.DestinationLongitude,
+					},
+					Status:        rideStatus.Status,
+					Stops:         toRideStops(waypoints),
+					WaypointIndex: rideStatus.WaypointSeq,
+					Pooled:        ride.Pooled,
+				}
+				if ride.ScheduledAt != nil {
+					scheduledAt := ride.ScheduledAt.UnixMilli()
+					responseData.ScheduledAt = &scheduledAt
+				}
+
+				// SSE形式で送信
+				data, err := json.Marshal(responseData)
+				if err != nil {
+					tx.Rollback()
+					return
+				}
+				fmt.Fprintf(w, "data:%s\n\n", data)
+				flusher.Flush()
+
+				// 送信済みマーク
+				_, err = tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, rideStatus.ID)
+				if err != nil {
+					tx.Rollback()
+					return
+				}
+			}
 		}
 
 		tx.Commit()
@@ -293,6 +494,11 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
+	// 通知を受け取っている間は椅子が動いているとみなす
+	if err := touchChairLiveness(ctx, chair.ID); err != nil {
+		slog.Error("failed to update chair liveness", "error", err)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -303,6 +509,9 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		case <-ticker.C:
 			// フォールバック: 定期的にもチェック
 			sendNotifications()
+			if err := touchChairLiveness(ctx, chair.ID); err != nil {
+				slog.Error("failed to update chair liveness", "error", err)
+			}
 		}
 	}
 }
@@ -315,14 +524,20 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	rideID := r.PathValue("ride_id")
 
-	chair := ctx.Value("chair").(*Chair)
-
 	req := &postChairRidesRideIDStatusRequest{}
 	if err := bindJSON(r, req); err != nil {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
+	// 目的地への到着は直前に受け付けた位置で判定するので、判定が終わるまで同じ椅子の位置を受け付けない。
+	// chairPostCoordinate と同じく、トランザクションを始める前にロックを取る
+	if req.Status == "ARRIVED" {
+		chair := ctx.Value("chair").(*Chair)
+		unlock := lockChairLocation(chair.ID)
+		defer unlock()
+	}
+
 	tx, err := db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -330,18 +545,9 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, "SELECT *, latest_status FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, errors.New("ride not found"))
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if ride.ChairID.String != chair.ID {
-		writeError(w, http.StatusBadRequest, errors.New("not assigned to this ride"))
+	ride, status, err := authorizeRide(ctx, tx, rideID, actionRideUpdateStatus, true)
+	if err != nil {
+		writeError(w, status, err)
 		return
 	}
 
@@ -366,6 +572,38 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+	// 位置からの到着の判定が働かなかった場合に、経由地を全て回って目的地の近くにいる椅子から目的地への到着を伝える
+	case "ARRIVED":
+		if !ride.LatestStatus.Valid || ride.LatestStatus.String != "CARRYING" {
+			writeError(w, http.StatusBadRequest, errors.New("chair is not carrying the user"))
+			return
+		}
+		unreachedWaypoints := 0
+		if err := tx.GetContext(ctx, &unreachedWaypoints, `SELECT COUNT(*) FROM ride_waypoints WHERE ride_id = ? AND reached_at IS NULL`, ride.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if unreachedWaypoints > 0 {
+			writeError(w, http.StatusBadRequest, errors.New("chair has not reached all waypoints yet"))
+			return
+		}
+		last, err := getChairLastLocation(ctx, tx, ride.ChairID.String)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if last == nil || time.Since(last.At) > manualArrivalMaxLocationAge {
+			writeError(w, http.StatusBadRequest, errors.New("chair location is unknown or too old"))
+			return
+		}
+		if calculateDistance(last.Latitude, last.Longitude, ride.DestinationLatitude, ride.DestinationLongitude) > manualArrivalMaxDistance {
+			writeError(w, http.StatusBadRequest, errors.New("chair is not near the destination"))
+			return
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
 	default:
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
 	}
@@ -377,3 +615,241 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// 椅子の売上は ownerGetSales と同じく、完了したライドの実際の決済額から返金額を引いたものとする
+const chairCompletedRidesFrom = `FROM rides r
+		 INNER JOIN ride_statuses rs ON rs.ride_id = r.id AND rs.status = 'COMPLETED'
+		 LEFT JOIN ride_payments p ON p.ride_id = r.id
+		 LEFT JOIN (SELECT ride_id, SUM(amount) AS amount FROM ride_refunds WHERE status = 'COMPLETED' GROUP BY ride_id) rf ON rf.ride_id = r.id`
+
+type chairGetRidesResponse struct {
+	Rides []chairGetRidesResponseItem `json:"rides"`
+	// 続きがあるときだけ返す。次のページを取得するときに cursor に指定する
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type chairGetRidesResponseItem struct {
+	ID                    string     `json:"id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Distance              int        `json:"distance"`
+	Fare                  int        `json:"fare"`
+	RefundedAmount        int        `json:"refunded_amount"`
+	Sales                 int        `json:"sales"`
+	Evaluation            *int       `json:"evaluation"`
+	RequestedAt           int64      `json:"requested_at"`
+	CompletedAt           int64      `json:"completed_at"`
+}
+
+// chairGetRides は椅子が担当して完了したライドを新しい順に cursor (ライドID) より古いものから limit 件ずつ返す
+func chairGetRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+	query := r.URL.Query()
+
+	conditions := "r.chair_id = ?"
+	args := []interface{}{chair.ID}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if _, err := ulid.ParseStrict(cursor); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid cursor"))
+			return
+		}
+		conditions += " AND r.id < ?"
+		args = append(args, cursor)
+	}
+	limit := 20
+	if query.Get("limit") != "" {
+		parsed, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || parsed <= 0 || parsed > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 100"))
+			return
+		}
+		limit = parsed
+	}
+	// 続きがあるかどうかを知るために1件多く取得する
+	args = append(args, limit+1)
+
+	rows := []struct {
+		ID                   string    `db:"id"`
+		PickupLatitude       int       `db:"pickup_latitude"`
+		PickupLongitude      int       `db:"pickup_longitude"`
+		DestinationLatitude  int       `db:"destination_latitude"`
+		DestinationLongitude int       `db:"destination_longitude"`
+		Distance             int       `db:"distance"`
+		Pooled               bool      `db:"pooled"`
+		Evaluation           *int      `db:"evaluation"`
+		RequestedAt          time.Time `db:"requested_at"`
+		CompletedAt          time.Time `db:"completed_at"`
+		PaymentAmount        *int      `db:"payment_amount"`
+		CouponDiscount       int       `db:"coupon_discount"`
+		RefundedAmount       int       `db:"refunded_amount"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT r.id, r.pickup_latitude, r.pickup_longitude, r.destination_latitude, r.destination_longitude, r.distance, r.pooled,
+		        r.evaluation, r.created_at AS requested_at, rs.created_at AS completed_at,
+		        p.amount AS payment_amount, COALESCE(cp.discount, 0) AS coupon_discount,
+		        CAST(COALESCE(rf.amount, 0) AS SIGNED) AS refunded_amount
+		 `+chairCompletedRidesFrom+`
+		 LEFT JOIN coupons cp ON cp.used_by = r.id
+		 WHERE `+conditions+`
+		 ORDER BY r.id DESC
+		 LIMIT ?`,
+		args...,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &chairGetRidesResponse{
+		Rides: []chairGetRidesResponseItem{},
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		res.NextCursor = rows[limit-1].ID
+	}
+	for _, row := range rows {
+		fare := chargedFare(row.Distance, row.Pooled, row.CouponDiscount, row.PaymentAmount)
+		sales := 0
+		if row.PaymentAmount != nil {
+			sales = *row.PaymentAmount - row.RefundedAmount
+		}
+		res.Rides = append(res.Rides, chairGetRidesResponseItem{
+			ID:                    row.ID,
+			PickupCoordinate:      Coordinate{Latitude: row.PickupLatitude, Longitude: row.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: row.DestinationLatitude, Longitude: row.DestinationLongitude},
+			Distance:              row.Distance,
+			Fare:                  fare,
+			RefundedAmount:        row.RefundedAmount,
+			Sales:                 sales,
+			Evaluation:            row.Evaluation,
+			RequestedAt:           row.RequestedAt.UnixMilli(),
+			CompletedAt:           row.CompletedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type chairGetEarningsResponse struct {
+	Since            int64   `json:"since"`
+	Until            int64   `json:"until"`
+	Sales            int     `json:"sales"`
+	RefundedAmount   int     `json:"refunded_amount"`
+	RidesCount       int     `json:"rides_count"`
+	UnpaidRidesCount int     `json:"unpaid_rides_count"`
+	Distance         int     `json:"distance"`
+	EvaluationAvg    float64 `json:"evaluation_avg"`
+}
+
+// chairGetEarnings は期間内に完了したライドの売上を集計する。期間は ownerGetSales と同じく since, until で指定する。
+// rides_count は売上に含まれる決済済みのライドの数で、決済が記録されていないライドは unpaid_rides_count に数える
+func chairGetEarnings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	since, until, err := parseTimeRangeQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	earnings := struct {
+		Sales            int     `db:"sales"`
+		RefundedAmount   int     `db:"refunded_amount"`
+		RidesCount       int     `db:"rides_count"`
+		UnpaidRidesCount int     `db:"unpaid_rides_count"`
+		Distance         int     `db:"distance"`
+		EvaluationAvg    float64 `db:"evaluation_avg"`
+	}{}
+	if err := db.GetContext(
+		ctx,
+		&earnings,
+		`SELECT CAST(COALESCE(SUM(p.amount - COALESCE(rf.amount, 0)), 0) AS SIGNED) AS sales,
+		        CAST(COALESCE(SUM(rf.amount), 0) AS SIGNED) AS refunded_amount,
+		        COUNT(p.ride_id) AS rides_count,
+		        COUNT(*) - COUNT(p.ride_id) AS unpaid_rides_count,
+		        CAST(COALESCE(SUM(r.distance), 0) AS SIGNED) AS distance,
+		        CAST(COALESCE(AVG(r.evaluation), 0) AS DOUBLE) AS evaluation_avg
+		 `+chairCompletedRidesFrom+`
+		 WHERE r.chair_id = ? AND rs.created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND`,
+		chair.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairGetEarningsResponse{
+		Since:            since.UnixMilli(),
+		Until:            until.UnixMilli(),
+		Sales:            earnings.Sales,
+		RefundedAmount:   earnings.RefundedAmount,
+		RidesCount:       earnings.RidesCount,
+		UnpaidRidesCount: earnings.UnpaidRidesCount,
+		Distance:         earnings.Distance,
+		EvaluationAvg:    earnings.EvaluationAvg,
+	})
+}
+
+type chairPostRideRatingRequest struct {
+	Rating int `json:"rating"`
+}
+
+// chairPostRideRating は椅子が目的地に到着した後のライドの利用者を評価する。評価は1ライドにつき1回だけ
+func chairPostRideRating(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	req := &chairPostRideRatingRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		writeError(w, http.StatusBadRequest, errors.New("rating must be between 1 and 5"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride, status, err := authorizeRide(ctx, tx, rideID, actionRideRateRider, true)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if !ride.LatestStatus.Valid || (ride.LatestStatus.String != "ARRIVED" && ride.LatestStatus.String != "COMPLETED") {
+		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO rider_ratings (ride_id, user_id, chair_id, rating) VALUES (?, ?, ?, ?)`,
+		ride.ID, ride.UserID, ride.ChairID.String, req.Rating,
+	); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDupEntry {
+			writeError(w, http.StatusConflict, errors.New("rider is already rated"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET rating_count = rating_count + 1, rating_sum = rating_sum + ? WHERE id = ?`, req.Rating, ride.UserID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
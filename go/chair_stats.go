@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// getChairStats は椅子の完了したライド数と評価の平均を返す。
+// 集計は chairs の completed_rides_count, evaluation_sum に逐次反映しているので1行読むだけで済む。
+// 通知のたびに呼ばれるので、評価で付けられたタグの回数は必要なところで getChairReviewTagCounts を使って読む
+func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
+	stats := appGetNotificationResponseChairStats{}
+
+	counters := struct {
+		CompletedRidesCount int `db:"completed_rides_count"`
+		EvaluationSum       int `db:"evaluation_sum"`
+	}{}
+	if err := tx.GetContext(ctx, &counters, `SELECT completed_rides_count, evaluation_sum FROM chairs WHERE id = ?`, chairID); err != nil {
+		return stats, err
+	}
+
+	stats.TotalRidesCount = counters.CompletedRidesCount
+	if counters.CompletedRidesCount > 0 {
+		stats.TotalEvaluationAvg = float64(counters.EvaluationSum) / float64(counters.CompletedRidesCount)
+	}
+
+	return stats, nil
+}
+
+// addChairRideStats はライドの評価とともに完了したライドを椅子の集計に加える
+func addChairRideStats(ctx context.Context, tx sqlx.ExecerContext, chairID string, evaluation int) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`UPDATE chairs SET completed_rides_count = completed_rides_count + 1, evaluation_sum = evaluation_sum + ? WHERE id = ?`,
+		evaluation, chairID,
+	)
+	return err
+}
+
+// backfillChairRideStats は既存のライドから椅子の集計を作り直す。
+// 以前の getChairStats と同じく、乗車 (CARRYING) と到着 (ARRIVED) を経て完了したライドだけを数える
+func backfillChairRideStats(ctx context.Context) error {
+	_, err := db.ExecContext(
+		ctx,
+		`UPDATE chairs c
+		 LEFT JOIN (
+		   SELECT r.chair_id, COUNT(*) AS completed_rides_count, COALESCE(SUM(r.evaluation), 0) AS evaluation_sum
+		   FROM rides r
+		   WHERE r.latest_status = 'COMPLETED'
+		     AND EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'ARRIVED')
+		     AND EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'CARRYING')
+		   GROUP BY r.chair_id
+		 ) s ON s.chair_id = c.id
+		 SET c.completed_rides_count = COALESCE(s.completed_rides_count, 0),
+		     c.evaluation_sum = COALESCE(s.evaluation_sum, 0)`,
+	)
+	return err
+}
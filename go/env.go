@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt は環境変数 name を整数として読む。未設定なら def を返し、解釈できないか min より小さければ警告して def を返す
+func envInt(name string, def int, min int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		slog.Warn(name+" is invalid. falling back to the default value", "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envFloat は環境変数 name を小数として読む。未設定なら def を返し、解釈できなければ警告して def を返す
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn(name+" is invalid. falling back to the default value", "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// envDuration は環境変数 name を time.ParseDuration の形式で読む。未設定なら def を返し、解釈できないか min より短ければ警告して def を返す
+func envDuration(name string, def time.Duration, min time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < min {
+		slog.Warn(name+" is invalid. falling back to the default value", "value", v, "default", def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvInt(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 10},
+		{value: "3", want: 3},
+		{value: "1", want: 1},
+		{value: "0", want: 10},
+		{value: "abc", want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("ISUCON_TEST_INT", tt.value)
+			if got := envInt("ISUCON_TEST_INT", 10, 1); got != tt.want {
+				t.Errorf("envInt() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvFloat(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{value: "", want: 1.5},
+		{value: "2.5", want: 2.5},
+		{value: "-1", want: -1},
+		{value: "abc", want: 1.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("ISUCON_TEST_FLOAT", tt.value)
+			if got := envFloat("ISUCON_TEST_FLOAT", 1.5); got != tt.want {
+				t.Errorf("envFloat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: time.Minute},
+		{value: "5s", want: 5 * time.Second},
+		{value: "0s", want: 0},
+		{value: "-1s", want: time.Minute},
+		{value: "10", want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("ISUCON_TEST_DURATION", tt.value)
+			if got := envDuration("ISUCON_TEST_DURATION", time.Minute, 0); got != tt.want {
+				t.Errorf("envDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeDB は DB を使う関数のテストのための database/sql のドライバ。
+// 実行された更新を記録し、SELECT には登録しておいた結果を返す
+type fakeDB struct {
+	mu      sync.Mutex
+	rows    map[string]fakeRows
+	execs   []fakeExec
+	commits int
+}
+
+// fakeExec は実行された更新とその引数
+type fakeExec struct {
+	Query string
+	Args  []any
+}
+
+// fakeRows は SELECT の結果
+type fakeRows struct {
+	Columns []string
+	Values  [][]driver.Value
+}
+
+// useFakeDB は db を fakeDB に差し替え、テストの終わりに元に戻す
+func useFakeDB(t *testing.T) *fakeDB {
+	t.Helper()
+	fake := &fakeDB{rows: map[string]fakeRows{}}
+	original := db
+	db = sqlx.NewDb(sql.OpenDB(fake), "mysql")
+	t.Cleanup(func() {
+		db.Close()
+		db = original
+	})
+	return fake
+}
+
+// setRows は query を含む SELECT に返す結果を登録する
+func (f *fakeDB) setRows(query string, columns []string, values ...[]driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rows[query] = fakeRows{Columns: columns, Values: values}
+}
+
+// executed は実行された更新を順に返す
+func (f *fakeDB) executed() []fakeExec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeExec{}, f.execs...)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fakeDB: use sql.OpenDB")
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakeDB: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	c.db.commits++
+	c.db.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	return nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	c.db.mu.Lock()
+	c.db.execs = append(c.db.execs, fakeExec{Query: query, Args: values})
+	c.db.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	for key, rows := range c.db.rows {
+		if strings.Contains(query, key) {
+			return &fakeRowsIter{rows: rows}, nil
+		}
+	}
+	return nil, errors.New("fakeDB: unexpected query: " + query)
+}
+
+type fakeRowsIter struct {
+	rows fakeRows
+	next int
+}
+
+func (r *fakeRowsIter) Columns() []string {
+	return r.rows.Columns
+}
+
+func (r *fakeRowsIter) Close() error {
+	return nil
+}
+
+func (r *fakeRowsIter) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows.Values) {
+		return io.EOF
+	}
+	copy(dest, r.rows.Values[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 椅子は chair_models.speed の距離をこの時間で移動する
+var chairSpeedUnit = envDuration("ISUCON_CHAIR_SPEED_UNIT", time.Second, time.Nanosecond)
+
+// true なら移動できない距離を移動した位置を受け付けない。
+// false なら記録だけして成功を返すが、その位置は移動距離や到着の判定、次の位置の検証には使わない
+var rejectChairLocationAnomalies = os.Getenv("ISUCON_REJECT_CHAIR_LOCATION_ANOMALIES") == "true"
+
+// chairMaxMoveDistance は速度 speed の椅子が elapsed の間に移動できる距離を求める。
+// 位置を送る間隔のぶれを見込んで、1単位時間ぶんの余裕を持たせる
+func chairMaxMoveDistance(speed int, elapsed time.Duration) int {
+	return speed * int(elapsed/chairSpeedUnit+1)
+}
+
+// 椅子のモデルごとの速度。chair_models はマスタデータなのでメモリに持っておく
+var (
+	chairModelSpeeds      = map[string]int{}
+	chairModelSpeedsMutex sync.RWMutex
+)
+
+// loadChairModelSpeeds は椅子のモデルごとの速度をDBから読み込み直す
+func loadChairModelSpeeds(ctx context.Context) error {
+	models := []ChairModel{}
+	if err := db.SelectContext(ctx, &models, `SELECT * FROM chair_models`); err != nil {
+		return err
+	}
+	speeds := make(map[string]int, len(models))
+	for _, model := range models {
+		speeds[model.Name] = model.Speed
+	}
+	chairModelSpeedsMutex.Lock()
+	chairModelSpeeds = speeds
+	chairModelSpeedsMutex.Unlock()
+	return nil
+}
+
+// getChairModelSpeed は椅子のモデルの速度を返す。読み込み済みの速度に無いモデルならDBから読み込み直す
+func getChairModelSpeed(ctx context.Context, model string) (int, error) {
+	chairModelSpeedsMutex.RLock()
+	speed, ok := chairModelSpeeds[model]
+	chairModelSpeedsMutex.RUnlock()
+	if ok {
+		return speed, nil
+	}
+	if err := loadChairModelSpeeds(ctx); err != nil {
+		return 0, err
+	}
+	chairModelSpeedsMutex.RLock()
+	speed, ok = chairModelSpeeds[model]
+	chairModelSpeedsMutex.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("unknown chair model: %s", model)
+	}
+	return speed, nil
+}
+
+// checkChairLocationAnomaly は前回の位置からの移動が速度 speed の椅子で可能かどうかを確かめ、
+// 不可能なら異常を返す。前回の位置が分からなければ判定しない
+func checkChairLocationAnomaly(chair *Chair, speed int, previous *chairLastLocation, current Coordinate, now time.Time) *ChairLocationAnomaly {
+	if previous == nil {
+		return nil
+	}
+
+	distance := calculateDistance(previous.Latitude, previous.Longitude, current.Latitude, current.Longitude)
+	maxDistance := chairMaxMoveDistance(speed, now.Sub(previous.At))
+	if distance <= maxDistance {
+		return nil
+	}
+
+	return &ChairLocationAnomaly{
+		ID:                ulid.Make().String(),
+		ChairID:           chair.ID,
+		PreviousLatitude:  previous.Latitude,
+		PreviousLongitude: previous.Longitude,
+		Latitude:          current.Latitude,
+		Longitude:         current.Longitude,
+		Distance:          distance,
+		MaxDistance:       maxDistance,
+		Rejected:          rejectChairLocationAnomalies,
+		CreatedAt:         now,
+	}
+}
+
+// recordChairLocationAnomaly は位置の異常を記録する
+func recordChairLocationAnomaly(ctx context.Context, tx sqlx.ExtContext, anomaly *ChairLocationAnomaly) error {
+	_, err := sqlx.NamedExecContext(
+		ctx,
+		tx,
+		`INSERT INTO chair_location_anomalies (id, chair_id, previous_latitude, previous_longitude, latitude, longitude, distance, max_distance, rejected, created_at)
+		 VALUES (:id, :chair_id, :previous_latitude, :previous_longitude, :latitude, :longitude, :distance, :max_distance, :rejected, :created_at)`,
+		anomaly,
+	)
+	return err
+}
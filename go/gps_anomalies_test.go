@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChairMaxMoveDistance(t *testing.T) {
+	defer func(unit time.Duration) { chairSpeedUnit = unit }(chairSpeedUnit)
+	chairSpeedUnit = time.Second
+
+	tests := []struct {
+		speed   int
+		elapsed time.Duration
+		want    int
+	}{
+		// 位置を送る間隔のぶれを見込んで、1単位時間ぶん多く移動できる
+		{speed: 3, elapsed: 0, want: 3},
+		{speed: 3, elapsed: 999 * time.Millisecond, want: 3},
+		{speed: 3, elapsed: time.Second, want: 6},
+		{speed: 3, elapsed: 2500 * time.Millisecond, want: 9},
+		{speed: 5, elapsed: 10 * time.Second, want: 55},
+	}
+	for _, tt := range tests {
+		if got := chairMaxMoveDistance(tt.speed, tt.elapsed); got != tt.want {
+			t.Errorf("chairMaxMoveDistance(%d, %v) = %d, want %d", tt.speed, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestCheckChairLocationAnomaly(t *testing.T) {
+	defer func(unit time.Duration, reject bool) {
+		chairSpeedUnit = unit
+		rejectChairLocationAnomalies = reject
+	}(chairSpeedUnit, rejectChairLocationAnomalies)
+	chairSpeedUnit = time.Second
+
+	chair := &Chair{ID: "chair1"}
+	now := time.Now()
+	// 速度 3 の椅子は 1 秒後に 6 まで移動できる
+	previous := &chairLastLocation{Coordinate: Coordinate{Latitude: 0, Longitude: 0}, At: now.Add(-time.Second)}
+
+	tests := []struct {
+		name     string
+		previous *chairLastLocation
+		current  Coordinate
+		reject   bool
+		// nil なら異常ではない
+		wantDistance *int
+		wantRejected bool
+	}{
+		{name: "no previous location", previous: nil, current: Coordinate{Latitude: 100, Longitude: 100}},
+		{name: "not moved", previous: previous, current: Coordinate{Latitude: 0, Longitude: 0}},
+		{name: "within speed", previous: previous, current: Coordinate{Latitude: 2, Longitude: 2}},
+		{name: "exactly max distance", previous: previous, current: Coordinate{Latitude: 3, Longitude: 3}},
+		{name: "one over max distance flagged", previous: previous, current: Coordinate{Latitude: 3, Longitude: 4}, wantDistance: ptr(7)},
+		{name: "one over max distance rejected", previous: previous, current: Coordinate{Latitude: 3, Longitude: 4}, reject: true, wantDistance: ptr(7), wantRejected: true},
+		{name: "teleport", previous: previous, current: Coordinate{Latitude: -100, Longitude: 100}, wantDistance: ptr(200)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejectChairLocationAnomalies = tt.reject
+			got := checkChairLocationAnomaly(chair, 3, tt.previous, tt.current, now)
+			if tt.wantDistance == nil {
+				if got != nil {
+					t.Errorf("checkChairLocationAnomaly() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("checkChairLocationAnomaly() = nil, want an anomaly")
+			}
+			if got.Distance != *tt.wantDistance || got.MaxDistance != 6 || got.Rejected != tt.wantRejected {
+				t.Errorf("checkChairLocationAnomaly() = {Distance: %d, MaxDistance: %d, Rejected: %v}, want {Distance: %d, MaxDistance: 6, Rejected: %v}",
+					got.Distance, got.MaxDistance, got.Rejected, *tt.wantDistance, tt.wantRejected)
+			}
+			if got.ChairID != chair.ID || got.PreviousLatitude != 0 || got.PreviousLongitude != 0 || got.Latitude != tt.current.Latitude || got.Longitude != tt.current.Longitude {
+				t.Errorf("checkChairLocationAnomaly() recorded wrong coordinates: %+v", got)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
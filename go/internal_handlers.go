@@ -4,13 +4,46 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
 )
 
+// 椅子からの評価の平均がこの値を下回る利用者のライドは、他のライドより後にマッチングする。0 なら評価を考慮しない
+var matchingLowRiderRatingThreshold = envFloat("ISUCON_MATCHING_LOW_RIDER_RATING", 0)
+
+// 評価が少ないうちは平均がぶれるので、この回数以上評価された利用者だけを後回しにする
+const matchingLowRiderRatingMinCount = 3
+
 // このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
+	// 予約されたライドは配車日時の scheduledRideLeadTime 前になるまでマッチングしない。キャンセルされたものも除く
+	matchableUntil := time.Now().Add(scheduledRideLeadTime)
+	var err error
+	if matchingLowRiderRatingThreshold > 0 {
+		err = db.GetContext(
+			ctx,
+			ride,
+			`SELECT r.*, r.pooled FROM rides r INNER JOIN users u ON u.id = r.user_id
+			 WHERE r.chair_id IS NULL AND r.latest_status = 'MATCHING' AND (r.scheduled_at IS NULL OR r.scheduled_at <= ?)
+			 ORDER BY (u.rating_count >= ? AND u.rating_sum < ? * u.rating_count), COALESCE(r.scheduled_at, r.created_at)
+			 LIMIT 1`,
+			matchableUntil, matchingLowRiderRatingMinCount, matchingLowRiderRatingThreshold,
+		)
+	} else {
+		err = db.GetContext(
+			ctx,
+			ride,
+			`SELECT *, pooled FROM rides
+			 WHERE chair_id IS NULL AND latest_status = 'MATCHING' AND (scheduled_at IS NULL OR scheduled_at <= ?)
+			 ORDER BY COALESCE(scheduled_at, created_at)
+			 LIMIT 1`,
+			matchableUntil,
+		)
+	}
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -19,12 +52,25 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 相乗りを希望したライドは、経路の近い相乗りのライドを受け持っている椅子に優先してアサインする
+	var pooledChair *Chair
+	if ride.Pooled {
+		pooledChair, err = findPooledChair(ctx, db, ride)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
 	// pickup座標に近い空いている椅子を取得してアサイン
 	matched := &Chair{}
 	query := `
 		SELECT c.*
 		FROM chairs c
 		WHERE c.is_active = TRUE
+		AND c.retired_at IS NULL
+		AND c.offline_at IS NULL
+		AND c.deactivated_by_owner = FALSE
 		AND c.latest_latitude IS NOT NULL
 		AND c.latest_longitude IS NOT NULL
 		AND NOT EXISTS (
@@ -36,7 +82,8 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 				FROM ride_statuses rs
 				WHERE rs.ride_id = r.id
 				GROUP BY rs.ride_id
-				HAVING COUNT(rs.chair_sent_at) < 6
+				-- 経由地への到着は数えず、COMPLETED まで椅子に通知し終えたライドだけを終わったものとする
+				HAVING COUNT(CASE WHEN rs.status <> 'WAYPOINT' THEN rs.chair_sent_at END) < 6
 			)
 		)
 		ORDER BY 
@@ -44,7 +91,9 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 			(c.latest_longitude - ?) * (c.latest_longitude - ?)
 		LIMIT 1
 	`
-	if err := db.GetContext(ctx, matched, query,
+	if pooledChair != nil {
+		matched = pooledChair
+	} else if err := db.GetContext(ctx, matched, query,
 		ride.PickupLatitude, ride.PickupLatitude,
 		ride.PickupLongitude, ride.PickupLongitude,
 	); err != nil {
@@ -56,8 +105,54 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 空いている椅子が見つかったのでアサイン
-	if _, err := db.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
+	// 同時に動いた別のマッチングで椅子の空きが埋まっていないよう、椅子の行をロックしてから受け持っているライドを読み直す
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	lockedChairID := ""
+	if err := tx.GetContext(ctx, &lockedChairID, `SELECT id FROM chairs WHERE id = ? FOR UPDATE`, matched.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	query, args, err := sqlx.In(unfinishedRidesOfChairsQuery+` FOR SHARE`, []string{matched.ID})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	assignedRides := []Ride{}
+	if err := tx.SelectContext(ctx, &assignedRides, tx.Rebind(query), args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	accepts := len(assignedRides) == 0
+	if pooledChair != nil {
+		accepts = pooledChairAccepts(pooledChair, assignedRides, ride)
+	}
+	if !accepts {
+		// 次のマッチングでやり直す
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// 空いている椅子が見つかったのでアサイン。別のマッチングでアサインされたかキャンセルされたライドはそのままにする
+	result, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ? AND chair_id IS NULL AND latest_status = 'MATCHING'", matched.ID, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if assigned, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if assigned == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -80,3 +175,51 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// 運営側の判断でライドを返金する。ISUCON_INTERNAL_API_TOKEN を知っている運営だけが叩ける
+func internalPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	req := &postRideRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT *, latest_status FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	reservation, status, err := reserveRideRefund(ctx, tx, ride, req, refundRequestedByAdmin, nil)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, status, err := completeRideRefund(ctx, reservation)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, res)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// 椅子から位置の送信も通知の受信も無いままこの時間が経つと、オフラインとみなしてマッチングの対象から外す。0 なら判定しない
+var chairLivenessTimeout = envDuration("ISUCON_CHAIR_LIVENESS_TIMEOUT", 30*time.Second, 0)
+
+// chairLiveness は椅子から最後に連絡があった日時と、オフラインとみなしているかどうか
+type chairLiveness struct {
+	LastSeenAt time.Time
+	Offline    bool
+}
+
+var (
+	chairLivenesses      = map[string]*chairLiveness{}
+	chairLivenessesMutex sync.Mutex
+)
+
+// touchChairLiveness は椅子から連絡があったことを記録する。オフラインとみなしていた椅子はマッチングの対象に戻す
+func touchChairLiveness(ctx context.Context, chairID string) error {
+	now := time.Now()
+	chairLivenessesMutex.Lock()
+	liveness, ok := chairLivenesses[chairID]
+	if !ok {
+		liveness = &chairLiveness{}
+		chairLivenesses[chairID] = liveness
+	}
+	liveness.LastSeenAt = now
+	wasOffline := liveness.Offline
+	liveness.Offline = false
+	chairLivenessesMutex.Unlock()
+
+	// 再起動などでメモリに無い場合も、オフラインのまま残っていないよう戻しておく
+	if wasOffline || !ok {
+		if _, err := db.ExecContext(ctx, `UPDATE chairs SET offline_at = NULL WHERE id = ? AND offline_at IS NOT NULL`, chairID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetChairLivenesses は記録した椅子からの連絡を全て消す
+func resetChairLivenesses() {
+	chairLivenessesMutex.Lock()
+	chairLivenesses = map[string]*chairLiveness{}
+	chairLivenessesMutex.Unlock()
+}
+
+// watchChairLiveness は一定間隔で椅子からの連絡が途絶えていないか確かめる
+func watchChairLiveness() {
+	if chairLivenessTimeout == 0 {
+		return
+	}
+	ticker := time.NewTicker(max(chairLivenessTimeout/10, time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := markSilentChairsOffline(context.Background()); err != nil {
+			slog.Error("failed to check chair liveness", "error", err)
+		}
+	}
+}
+
+// markSilentChairsOffline は連絡が途絶えた配車受付中の椅子をオフラインにする
+func markSilentChairsOffline(ctx context.Context) error {
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, `SELECT id FROM chairs WHERE is_active = TRUE AND retired_at IS NULL AND offline_at IS NULL`); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	silentChairIDs := []string{}
+	chairLivenessesMutex.Lock()
+	for _, chairID := range chairIDs {
+		liveness, ok := chairLivenesses[chairID]
+		if !ok {
+			// まだ一度も連絡が無い椅子は、ここから時間を数える
+			chairLivenesses[chairID] = &chairLiveness{LastSeenAt: now}
+			continue
+		}
+		if !liveness.Offline && now.Sub(liveness.LastSeenAt) >= chairLivenessTimeout {
+			silentChairIDs = append(silentChairIDs, chairID)
+		}
+	}
+	chairLivenessesMutex.Unlock()
+
+	for _, chairID := range silentChairIDs {
+		if err := markChairOffline(ctx, chairID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markChairOffline は椅子をマッチングの対象から外してオーナーに知らせる。
+// 割り当て済みでまだ迎車を始めていないライドは、他の椅子に割り当て直せるようマッチング待ちに戻す
+func markChairOffline(ctx context.Context, chairID string, now time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ? FOR UPDATE`, chairID); err != nil {
+		return err
+	}
+	// 行をロックするまでの間に連絡があれば、オフラインにしない
+	chairLivenessesMutex.Lock()
+	liveness, ok := chairLivenesses[chairID]
+	silent := ok && now.Sub(liveness.LastSeenAt) >= chairLivenessTimeout
+	chairLivenessesMutex.Unlock()
+	if !silent {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE chairs SET offline_at = ? WHERE id = ?`, now, chairID); err != nil {
+		return err
+	}
+
+	rideIDs := []string{}
+	if err := tx.SelectContext(ctx, &rideIDs, `SELECT id FROM rides WHERE chair_id = ? AND latest_status = 'MATCHING' FOR UPDATE`, chairID); err != nil {
+		return err
+	}
+	for _, rideID := range rideIDs {
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET chair_id = NULL WHERE id = ?`, rideID); err != nil {
+			return err
+		}
+		// 新しく割り当てられた椅子にもマッチングを通知できるよう、椅子への通知を未送信に戻す
+		if _, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = NULL WHERE ride_id = ?`, rideID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO owner_notifications (id, owner_id, chair_id, type, reassigned_rides_count, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		ulid.Make().String(), chair.OwnerID, chair.ID, "CHAIR_OFFLINE", len(rideIDs), now,
+	); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// コミットまでの間に連絡があっても、次の連絡でオンラインに戻る
+	chairLivenessesMutex.Lock()
+	liveness.Offline = true
+	chairLivenessesMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clearChairOfflineQuery = `UPDATE chairs SET offline_at = NULL WHERE id = ? AND offline_at IS NOT NULL`
+
+func TestTouchChairLiveness(t *testing.T) {
+	tests := []struct {
+		name      string
+		liveness  *chairLiveness
+		wantClear bool
+	}{
+		{name: "unknown chair", liveness: nil, wantClear: true},
+		{name: "offline chair", liveness: &chairLiveness{LastSeenAt: time.Now().Add(-time.Hour), Offline: true}, wantClear: true},
+		{name: "online chair", liveness: &chairLiveness{LastSeenAt: time.Now().Add(-time.Second)}, wantClear: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			resetChairLivenesses()
+			defer resetChairLivenesses()
+			if tt.liveness != nil {
+				chairLivenesses["chair1"] = tt.liveness
+			}
+
+			before := time.Now()
+			if err := touchChairLiveness(context.Background(), "chair1"); err != nil {
+				t.Fatalf("touchChairLiveness() error = %v", err)
+			}
+
+			execs := fake.executed()
+			if tt.wantClear {
+				if len(execs) != 1 || execs[0].Query != clearChairOfflineQuery || execs[0].Args[0] != "chair1" {
+					t.Errorf("executed = %v, want offline_at of chair1 cleared", execs)
+				}
+			} else if len(execs) != 0 {
+				t.Errorf("executed = %v, want nothing", execs)
+			}
+			liveness := chairLivenesses["chair1"]
+			if liveness.Offline {
+				t.Errorf("Offline = true, want false")
+			}
+			if liveness.LastSeenAt.Before(before) {
+				t.Errorf("LastSeenAt = %v, want after %v", liveness.LastSeenAt, before)
+			}
+		})
+	}
+}
+
+func TestMarkChairOffline(t *testing.T) {
+	defer func(timeout time.Duration) { chairLivenessTimeout = timeout }(chairLivenessTimeout)
+	chairLivenessTimeout = 30 * time.Second
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		lastSeenAt  time.Time
+		rideIDs     []string
+		wantOffline bool
+	}{
+		{name: "silent chair with matching rides", lastSeenAt: now.Add(-time.Minute), rideIDs: []string{"ride1", "ride2"}, wantOffline: true},
+		{name: "silent chair without rides", lastSeenAt: now.Add(-chairLivenessTimeout), wantOffline: true},
+		{name: "seen before the lock", lastSeenAt: now.Add(-time.Second), rideIDs: []string{"ride1"}, wantOffline: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			resetChairLivenesses()
+			defer resetChairLivenesses()
+			chairLivenesses["chair1"] = &chairLiveness{LastSeenAt: tt.lastSeenAt}
+
+			fake.setRows(`FROM chairs WHERE id = ? FOR UPDATE`, []string{"id", "owner_id"}, []driver.Value{"chair1", "owner1"})
+			rides := make([][]driver.Value, len(tt.rideIDs))
+			for i, rideID := range tt.rideIDs {
+				rides[i] = []driver.Value{rideID}
+			}
+			fake.setRows(`FROM rides WHERE chair_id = ? AND latest_status = 'MATCHING'`, []string{"id"}, rides...)
+
+			if err := markChairOffline(context.Background(), "chair1", now); err != nil {
+				t.Fatalf("markChairOffline() error = %v", err)
+			}
+
+			execs := fake.executed()
+			if !tt.wantOffline {
+				if len(execs) != 0 || fake.commits != 0 {
+					t.Errorf("executed = %v, commits = %d, want nothing", execs, fake.commits)
+				}
+				if chairLivenesses["chair1"].Offline {
+					t.Errorf("Offline = true, want false")
+				}
+				return
+			}
+
+			want := []fakeExec{{Query: `UPDATE chairs SET offline_at = ? WHERE id = ?`, Args: []any{now, "chair1"}}}
+			for _, rideID := range tt.rideIDs {
+				want = append(want,
+					fakeExec{Query: `UPDATE rides SET chair_id = NULL WHERE id = ?`, Args: []any{rideID}},
+					fakeExec{Query: `UPDATE ride_statuses SET chair_sent_at = NULL WHERE ride_id = ?`, Args: []any{rideID}},
+				)
+			}
+			if len(execs) != len(want)+1 {
+				t.Fatalf("executed = %v, want %v followed by the notification", execs, want)
+			}
+			for i, w := range want {
+				if execs[i].Query != w.Query || !equalExecArgs(execs[i].Args, w.Args) {
+					t.Errorf("executed[%d] = %v, want %v", i, execs[i], w)
+				}
+			}
+			notification := execs[len(want)]
+			if !strings.HasPrefix(notification.Query, `INSERT INTO owner_notifications`) {
+				t.Fatalf("executed[%d] = %v, want the owner notification", len(want), notification)
+			}
+			if got := notification.Args[1:5]; !equalExecArgs(got, []any{"owner1", "chair1", "CHAIR_OFFLINE", int64(len(tt.rideIDs))}) {
+				t.Errorf("notification args = %v, want owner1, chair1, CHAIR_OFFLINE, %d", got, len(tt.rideIDs))
+			}
+			if fake.commits != 1 {
+				t.Errorf("commits = %d, want 1", fake.commits)
+			}
+			if !chairLivenesses["chair1"].Offline {
+				t.Errorf("Offline = false, want true")
+			}
+		})
+	}
+}
+
+func equalExecArgs(got, want []any) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if gotTime, ok := got[i].(time.Time); ok {
+			if wantTime, ok := want[i].(time.Time); !ok || !gotTime.Equal(wantTime) {
+				return false
+			}
+			continue
+		}
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
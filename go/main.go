@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -12,15 +13,19 @@ import (
 	"strconv"
 	"sync"
 	"time"
-    "github.com/kaz/pprotein/integration"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/kaz/pprotein/integration"
 )
 
 var db *sqlx.DB
 
+// ER_DUP_ENTRY
+const mysqlErrDupEntry = 1062
+
 // 通知チャネル管理
 var (
 	appNotificationChannels   = make(map[string]chan struct{})
@@ -35,12 +40,29 @@ var (
 )
 
 func main() {
+	if len(tokenHashSecret) == 0 {
+		slog.Error("ISUCON_TOKEN_SECRET is required")
+		os.Exit(1)
+	}
+
+	// 既存DBのトークンをハッシュ化するための一回限りのコマンド
+	//   ./isuride hash-tokens
+	if len(os.Args) > 1 && os.Args[1] == "hash-tokens" {
+		connectDB()
+		if err := migrateTokenHashes(context.Background()); err != nil {
+			slog.Error("failed to hash tokens", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("tokens hashed")
+		return
+	}
+
 	mux := setup()
 	slog.Info("Listening on :8080")
 	http.ListenAndServe(":8080", mux)
 }
 
-func setup() http.Handler {
+func connectDB() {
 	host := os.Getenv("ISUCON_DB_HOST")
 	if host == "" {
 		host = "127.0.0.1"
@@ -82,6 +104,10 @@ func setup() http.Handler {
 	db = _db
 	db.SetMaxOpenConns(100)
 	db.SetMaxIdleConns(100)
+}
+
+func setup() http.Handler {
+	connectDB()
 
 	mux := chi.NewRouter()
 	mux.Use(middleware.Logger)
@@ -93,10 +119,17 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/app/users", appPostUsers)
 
 		authedMux := mux.With(appAuthMiddleware)
+		authedMux.HandleFunc("POST /api/app/logout", appPostLogout)
+		authedMux.HandleFunc("POST /api/app/rotate-token", appPostRotateToken)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
+		authedMux.HandleFunc("GET /api/app/payment-methods", appGetPaymentMethods)
+		authedMux.HandleFunc("DELETE /api/app/payment-methods/{token}", appDeletePaymentMethod)
+		authedMux.HandleFunc("POST /api/app/payment-methods/{token}/default", appPostPaymentMethodDefault)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}", appGetRide)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
@@ -107,8 +140,23 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
 
 		authedMux := mux.With(ownerAuthMiddleware)
+		authedMux.HandleFunc("POST /api/owner/logout", ownerPostLogout)
+		authedMux.HandleFunc("POST /api/owner/rotate-token", ownerPostRotateToken)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/timeseries", ownerGetSalesTimeseries)
+		authedMux.HandleFunc("GET /api/owner/notifications", ownerGetNotifications)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}", ownerGetChairDetail)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/reviews", ownerGetChairReviews)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/anomalies", ownerGetChairAnomalies)
+		authedMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		authedMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}", ownerDeleteChair)
+		authedMux.HandleFunc("GET /api/owner/chair-register-tokens", ownerGetChairRegisterTokens)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens", ownerPostChairRegisterToken)
+		authedMux.HandleFunc("PATCH /api/owner/chair-register-tokens/{token_id}", ownerPatchChairRegisterToken)
+		authedMux.HandleFunc("DELETE /api/owner/chair-register-tokens/{token_id}", ownerDeleteChairRegisterToken)
+		authedMux.HandleFunc("GET /api/owner/rides/export", ownerGetRidesExport)
+		authedMux.HandleFunc("POST /api/owner/rides/{ride_id}/refunds", ownerPostRideRefund)
 	}
 
 	// chair handlers
@@ -116,15 +164,23 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/chair/chairs", chairPostChairs)
 
 		authedMux := mux.With(chairAuthMiddleware)
+		authedMux.HandleFunc("POST /api/chair/logout", chairPostLogout)
+		authedMux.HandleFunc("POST /api/chair/rotate-token", chairPostRotateToken)
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
 		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
+		authedMux.HandleFunc("GET /api/chair/rides", chairGetRides)
+		authedMux.HandleFunc("GET /api/chair/earnings", chairGetEarnings)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/rating", chairPostRideRating)
 	}
 
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+
+		authedMux := mux.With(internalAuthMiddleware)
+		authedMux.HandleFunc("POST /api/internal/rides/{ride_id}/refunds", internalPostRideRefund)
 	}
 
 	pproteinHandler := integration.NewDebugHandler()
@@ -132,6 +188,8 @@ func setup() http.Handler {
 
 	// chair_locations のバルクインサート用goroutineを起動
 	go bulkInsertChairLocations()
+	go watchChairLiveness()
+	go sweepSessionCaches()
 
 	return mux
 }
@@ -152,7 +210,13 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
+	cmd := exec.Command("../sql/init.sh")
+	cmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("ISUCON_INITIAL_FARE=%d", initialFare),
+		fmt.Sprintf("ISUCON_FARE_PER_DISTANCE=%d", farePerDistance),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
 	}
@@ -162,17 +226,47 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 初期データのトークンは平文なのでハッシュに置き換える
+	if err := migrateTokenHashes(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 椅子の評価の集計を初期データから作る
+	if err := backfillChairRideStats(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	// 通知チャネルをクリア
 	notificationMutex.Lock()
 	appNotificationChannels = make(map[string]chan struct{})
 	chairNotificationChannels = make(map[string]chan struct{})
 	notificationMutex.Unlock()
 
+	// 椅子のモデルの速度を読み込み直す
+	if err := loadChairModelSpeeds(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 認証キャッシュを作り直す
+	if err := warmSessionCaches(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	// chair_locationsバッファをクリア
 	chairLocationBufferMutex.Lock()
 	chairLocationBuffer = []ChairLocation{}
 	chairLocationBufferMutex.Unlock()
 
+	chairLastLocationsMutex.Lock()
+	chairLastLocations = map[string]chairLastLocation{}
+	chairLastLocationsMutex.Unlock()
+
+	resetChairLivenesses()
+
 	go func() {
 		if _, err := http.Get("http://54.238.146.225:9000/api/group/collect"); err != nil {
 			//log.Printf("failed to communicate with pprotein: %v", err)
@@ -213,7 +307,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "error", err)
 }
 
 func secureRandomStr(b int) string {
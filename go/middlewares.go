@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"net/http"
+	"os"
+	"strings"
 )
 
+// 運営向けの内部APIを叩くときに Authorization: Bearer で渡す共有の秘密。未設定なら内部APIは誰にも使わせない
+var internalAPIToken = os.Getenv("ISUCON_INTERNAL_API_TOKEN")
+
 func appAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -16,11 +22,19 @@ func appAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 		accessToken := c.Value
-		user := &User{}
-		err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
+		userID, err := appSessionCache.lookup(ctx, accessToken)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or expired access token"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		user := &User{}
+		if err := db.GetContext(ctx, user, `SELECT * FROM users WHERE id = ?`, userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or expired access token"))
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
@@ -41,10 +55,19 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 		accessToken := c.Value
+		ownerID, err := ownerSessionCache.lookup(ctx, accessToken)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or expired access token"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
 		owner := &Owner{}
-		if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
+		if err := db.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, ownerID); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or expired access token"))
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
@@ -65,11 +88,19 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 		accessToken := c.Value
-		chair := &Chair{}
-		err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken)
+		chairID, err := chairSessionCache.lookup(ctx, accessToken)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or expired access token"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		chair := &Chair{}
+		if err := db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, chairID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or expired access token"))
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
@@ -80,3 +111,18 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+func internalAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if internalAPIToken == "" {
+			writeError(w, http.StatusForbidden, errors.New("internal api is disabled"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(internalAPIToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid internal api token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -11,7 +11,6 @@ type Chair struct {
 	Name                    string     `db:"name"`
 	Model                   string     `db:"model"`
 	IsActive                bool       `db:"is_active"`
-	AccessToken             string     `db:"access_token"`
 	CreatedAt               time.Time  `db:"created_at"`
 	UpdatedAt               time.Time  `db:"updated_at"`
 	LatestLatitude          *int       `db:"latest_latitude"`
@@ -19,6 +18,9 @@ type Chair struct {
 	LatestLocationUpdatedAt *time.Time `db:"latest_location_updated_at"`
 	TotalDistance           int        `db:"total_distance"`
 	TotalDistanceUpdatedAt  *time.Time `db:"total_distance_updated_at"`
+	RetiredAt               *time.Time `db:"retired_at"`
+	OfflineAt               *time.Time `db:"offline_at"`
+	DeactivatedByOwner      bool       `db:"deactivated_by_owner"`
 }
 
 type ChairModel struct {
@@ -26,6 +28,26 @@ type ChairModel struct {
 	Speed int    `db:"speed"`
 }
 
+type ChairActivity struct {
+	ID        string    `db:"id"`
+	ChairID   string    `db:"chair_id"`
+	IsActive  bool      `db:"is_active"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type ChairLocationAnomaly struct {
+	ID                string    `db:"id"`
+	ChairID           string    `db:"chair_id"`
+	PreviousLatitude  int       `db:"previous_latitude"`
+	PreviousLongitude int       `db:"previous_longitude"`
+	Latitude          int       `db:"latitude"`
+	Longitude         int       `db:"longitude"`
+	Distance          int       `db:"distance"`
+	MaxDistance       int       `db:"max_distance"`
+	Rejected          bool      `db:"rejected"`
+	CreatedAt         time.Time `db:"created_at"`
+}
+
 type ChairLocation struct {
 	ID        string    `db:"id"`
 	ChairID   string    `db:"chair_id"`
@@ -40,16 +62,27 @@ type User struct {
 	Firstname      string    `db:"firstname"`
 	Lastname       string    `db:"lastname"`
 	DateOfBirth    string    `db:"date_of_birth"`
-	AccessToken    string    `db:"access_token"`
 	InvitationCode string    `db:"invitation_code"`
 	CreatedAt      time.Time `db:"created_at"`
 	UpdatedAt      time.Time `db:"updated_at"`
+	RatingCount    int       `db:"rating_count"`
+	RatingSum      int       `db:"rating_sum"`
+}
+
+// ratingAvg は椅子からの評価の平均を返す。まだ評価されていなければ nil
+func (u *User) ratingAvg() *float64 {
+	if u.RatingCount == 0 {
+		return nil
+	}
+	avg := float64(u.RatingSum) / float64(u.RatingCount)
+	return &avg
 }
 
 type PaymentToken struct {
 	UserID    string    `db:"user_id"`
 	Token     string    `db:"token"`
 	CreatedAt time.Time `db:"created_at"`
+	IsDefault bool      `db:"is_default"`
 }
 
 type Ride struct {
@@ -64,6 +97,46 @@ type Ride struct {
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
 	LatestStatus         sql.NullString `db:"latest_status"`
+	ScheduledAt          *time.Time     `db:"scheduled_at"`
+	Distance             int            `db:"distance"`
+	Pooled               bool           `db:"pooled"`
+}
+
+type RidePayment struct {
+	RideID           string    `db:"ride_id"`
+	UserID           string    `db:"user_id"`
+	Token            string    `db:"token"`
+	Amount           int       `db:"amount"`
+	GatewayPaymentID *string   `db:"gateway_payment_id"`
+	CreatedAt        time.Time `db:"created_at"`
+}
+
+type RideRefund struct {
+	ID              string    `db:"id"`
+	RideID          string    `db:"ride_id"`
+	Amount          int       `db:"amount"`
+	Reason          string    `db:"reason"`
+	RequestedBy     string    `db:"requested_by"`
+	RequesterID     *string   `db:"requester_id"`
+	GatewayRefundID *string   `db:"gateway_refund_id"`
+	Status          string    `db:"status"`
+	CreatedAt       time.Time `db:"created_at"`
+}
+
+type RideReview struct {
+	RideID    string    `db:"ride_id"`
+	ChairID   string    `db:"chair_id"`
+	Comment   string    `db:"comment"`
+	Tags      string    `db:"tags"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type RiderRating struct {
+	RideID    string    `db:"ride_id"`
+	UserID    string    `db:"user_id"`
+	ChairID   string    `db:"chair_id"`
+	Rating    int       `db:"rating"`
+	CreatedAt time.Time `db:"created_at"`
 }
 
 type RideStatus struct {
@@ -73,15 +146,67 @@ type RideStatus struct {
 	CreatedAt   time.Time  `db:"created_at"`
 	AppSentAt   *time.Time `db:"app_sent_at"`
 	ChairSentAt *time.Time `db:"chair_sent_at"`
+	WaypointSeq *int       `db:"waypoint_seq"`
+}
+
+type RideWaypoint struct {
+	RideID    string     `db:"ride_id"`
+	Seq       int        `db:"seq"`
+	Latitude  int        `db:"latitude"`
+	Longitude int        `db:"longitude"`
+	ReachedAt *time.Time `db:"reached_at"`
 }
 
 type Owner struct {
-	ID                 string    `db:"id"`
-	Name               string    `db:"name"`
-	AccessToken        string    `db:"access_token"`
-	ChairRegisterToken string    `db:"chair_register_token"`
-	CreatedAt          time.Time `db:"created_at"`
-	UpdatedAt          time.Time `db:"updated_at"`
+	ID        string    `db:"id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type ChairRegisterToken struct {
+	ID        string     `db:"id"`
+	OwnerID   string     `db:"owner_id"`
+	Token     string     `db:"token"`
+	Label     string     `db:"label"`
+	MaxUses   *int       `db:"max_uses"`
+	UsedCount int        `db:"used_count"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+}
+
+// available は椅子の登録にこのトークンを使えるかどうかを返す
+func (t *ChairRegisterToken) available(now time.Time) bool {
+	if t.RevokedAt != nil {
+		return false
+	}
+	if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return false
+	}
+	if t.MaxUses != nil && t.UsedCount >= *t.MaxUses {
+		return false
+	}
+	return true
+}
+
+type Session struct {
+	Token       string     `db:"token"`
+	Role        string     `db:"role"`
+	PrincipalID string     `db:"principal_id"`
+	ExpiresAt   time.Time  `db:"expires_at"`
+	RevokedAt   *time.Time `db:"revoked_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+type OwnerNotification struct {
+	ID                   string    `db:"id"`
+	OwnerID              string    `db:"owner_id"`
+	ChairID              string    `db:"chair_id"`
+	Type                 string    `db:"type"`
+	ReassignedRidesCount int       `db:"reassigned_rides_count"`
+	CreatedAt            time.Time `db:"created_at"`
 }
 
 type Coupon struct {
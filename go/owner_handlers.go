@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -39,21 +49,40 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	accessToken := secureRandomStr(32)
 	chairRegisterToken := secureRandomStr(32)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)",
-		ownerID, req.Name, accessToken, chairRegisterToken,
+		"INSERT INTO owners (id, name) VALUES (?, ?)",
+		ownerID, req.Name,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "owner_session",
-		Value: accessToken,
-	})
+	if _, err := createChairRegisterToken(ctx, tx, ownerID, chairRegisterToken, "default", nil, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	expiresAt, err := createSession(ctx, tx, sessionRoleOwner, ownerID, accessToken)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	setSessionCookie(w, sessionRoleOwner, accessToken, expiresAt)
 
 	writeJSON(w, http.StatusCreated, &ownerPostOwnersResponse{
 		ID:                 ownerID,
@@ -61,6 +90,238 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func ownerPostLogout(w http.ResponseWriter, r *http.Request) {
+	postSessionLogout(w, r, sessionRoleOwner)
+}
+
+func ownerPostRotateToken(w http.ResponseWriter, r *http.Request) {
+	owner := r.Context().Value("owner").(*Owner)
+	postSessionRotate(w, r, sessionRoleOwner, owner.ID)
+}
+
+// createChairRegisterToken は椅子登録トークンを発行してIDを返す
+func createChairRegisterToken(ctx context.Context, tx sqlx.ExecerContext, ownerID string, token string, label string, maxUses *int, expiresAt *time.Time) (string, error) {
+	id := ulid.Make().String()
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_register_tokens (id, owner_id, token, label, max_uses, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, ownerID, hashToken(token), label, maxUses, expiresAt,
+	)
+	return id, err
+}
+
+type ownerChairRegisterToken struct {
+	ID        string `json:"id"`
+	Label     string `json:"label"`
+	MaxUses   *int   `json:"max_uses"`
+	UsedCount int    `json:"used_count"`
+	ExpiresAt *int64 `json:"expires_at"`
+	RevokedAt *int64 `json:"revoked_at"`
+	CreatedAt int64  `json:"created_at"`
+	// 失効・期限切れ・上限到達のいずれでもなく、椅子の登録に使えるかどうか
+	Available bool `json:"available"`
+}
+
+func newOwnerChairRegisterToken(t *ChairRegisterToken, now time.Time) ownerChairRegisterToken {
+	res := ownerChairRegisterToken{
+		ID:        t.ID,
+		Label:     t.Label,
+		MaxUses:   t.MaxUses,
+		UsedCount: t.UsedCount,
+		CreatedAt: t.CreatedAt.UnixMilli(),
+		Available: t.available(now),
+	}
+	if t.ExpiresAt != nil {
+		expiresAt := t.ExpiresAt.UnixMilli()
+		res.ExpiresAt = &expiresAt
+	}
+	if t.RevokedAt != nil {
+		revokedAt := t.RevokedAt.UnixMilli()
+		res.RevokedAt = &revokedAt
+	}
+	return res
+}
+
+type ownerGetChairRegisterTokensResponse struct {
+	Tokens []ownerChairRegisterToken `json:"tokens"`
+}
+
+func ownerGetChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	tokens := []ChairRegisterToken{}
+	if err := db.SelectContext(ctx, &tokens, `SELECT * FROM chair_register_tokens WHERE owner_id = ? ORDER BY created_at DESC, id DESC`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	res := ownerGetChairRegisterTokensResponse{
+		Tokens: make([]ownerChairRegisterToken, 0, len(tokens)),
+	}
+	for i := range tokens {
+		res.Tokens = append(res.Tokens, newOwnerChairRegisterToken(&tokens[i], now))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPostChairRegisterTokenRequest struct {
+	Label   string `json:"label"`
+	MaxUses *int   `json:"max_uses"`
+	// UnixMilli。省略された場合は無期限
+	ExpiresAt *int64 `json:"expires_at"`
+}
+
+type ownerPostChairRegisterTokenResponse struct {
+	ownerChairRegisterToken
+	// トークンはハッシュで保存するので、平文を返すのは発行時だけ
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+func ownerPostChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostChairRegisterTokenRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if utf8.RuneCountInString(req.Label) > 255 {
+		writeError(w, http.StatusBadRequest, errors.New("label is too long"))
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_uses must be positive"))
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		t := time.UnixMilli(*req.ExpiresAt)
+		if !t.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("expires_at must be in the future"))
+			return
+		}
+		expiresAt = &t
+	}
+
+	token := secureRandomStr(32)
+	id, err := createChairRegisterToken(ctx, db, owner.ID, token, req.Label, req.MaxUses, expiresAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	created := &ChairRegisterToken{}
+	if err := db.GetContext(ctx, created, `SELECT * FROM chair_register_tokens WHERE id = ?`, id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &ownerPostChairRegisterTokenResponse{
+		ownerChairRegisterToken: newOwnerChairRegisterToken(created, time.Now()),
+		ChairRegisterToken:      token,
+	})
+}
+
+type ownerPatchChairRegisterTokenRequest struct {
+	Label *string `json:"label"`
+	// UnixMilli。現在時刻以前を指定すると即座に期限切れにできる
+	ExpiresAt *int64 `json:"expires_at"`
+}
+
+func ownerPatchChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tokenID := r.PathValue("token_id")
+
+	req := &ownerPatchChairRegisterTokenRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Label != nil && utf8.RuneCountInString(*req.Label) > 255 {
+		writeError(w, http.StatusBadRequest, errors.New("label is too long"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	token, status, err := authorizeChairRegisterToken(ctx, tx, tokenID, actionChairRegisterTokenManage, true)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if token.RevokedAt != nil {
+		writeError(w, http.StatusConflict, errors.New("chair register token is revoked"))
+		return
+	}
+
+	if req.Label != nil {
+		if _, err := tx.ExecContext(ctx, `UPDATE chair_register_tokens SET label = ? WHERE id = ?`, *req.Label, token.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if req.ExpiresAt != nil {
+		if _, err := tx.ExecContext(ctx, `UPDATE chair_register_tokens SET expires_at = ? WHERE id = ?`, time.UnixMilli(*req.ExpiresAt), token.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.GetContext(ctx, token, `SELECT * FROM chair_register_tokens WHERE id = ?`, token.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerChairRegisterToken(token, time.Now()))
+}
+
+// ownerDeleteChairRegisterToken は椅子登録トークンを失効させる。登録済みの椅子には影響しない
+func ownerDeleteChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tokenID := r.PathValue("token_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	token, status, err := authorizeChairRegisterToken(ctx, tx, tokenID, actionChairRegisterTokenManage, true)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	// 既に失効済みのトークンは失効日時を変えない
+	if token.RevokedAt == nil {
+		if _, err := tx.ExecContext(ctx, `UPDATE chair_register_tokens SET revoked_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, token.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type chairSales struct {
 	ID    string `json:"id"`
 	Name  string `json:"name"`
@@ -78,101 +339,399 @@ type ownerGetSalesResponse struct {
 	Models     []modelSales `json:"models"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// parseTimeRangeQuery は since, until クエリパラメータ (UnixMilli) を解釈する。省略された場合は全期間になる
+func parseTimeRangeQuery(r *http.Request) (time.Time, time.Time, error) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		until = time.UnixMilli(parsed)
 	}
+	return since, until, nil
+}
 
-	owner := r.Context().Value("owner").(*Owner)
-
-	tx, err := db.Beginx()
+func ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseTimeRangeQuery(r)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer tx.Rollback()
 
-	chairs := []Chair{}
-	if err := tx.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+	owner := r.Context().Value("owner").(*Owner)
+
+	// 椅子ごとに、期間内に完了したライドの実際の決済額から返金額を引いたものを集計する
+	rows := []struct {
+		ID    string `db:"id"`
+		Name  string `db:"name"`
+		Model string `db:"model"`
+		Sales int    `db:"sales"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT c.id, c.name, c.model, CAST(COALESCE(SUM(p.amount - COALESCE(rf.amount, 0)), 0) AS SIGNED) AS sales
+		 FROM chairs c
+		 LEFT JOIN rides r ON r.chair_id = c.id
+		 LEFT JOIN ride_statuses rs ON rs.ride_id = r.id AND rs.status = 'COMPLETED'
+		 LEFT JOIN ride_payments p ON p.ride_id = rs.ride_id AND rs.created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		 LEFT JOIN (SELECT ride_id, SUM(amount) AS amount FROM ride_refunds WHERE status = 'COMPLETED' GROUP BY ride_id) rf ON rf.ride_id = p.ride_id
+		 WHERE c.owner_id = ?
+		 GROUP BY c.id, c.name, c.model
+		 ORDER BY c.id`,
+		since, until, owner.ID,
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	res := ownerGetSalesResponse{
 		TotalSales: 0,
+		Chairs:     []chairSales{},
+		Models:     []modelSales{},
 	}
 
 	modelSalesByModel := map[string]int{}
-	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		sales := sumSales(rides)
-		res.TotalSales += sales
-
+	for _, row := range rows {
+		res.TotalSales += row.Sales
 		res.Chairs = append(res.Chairs, chairSales{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Sales: sales,
+			ID:    row.ID,
+			Name:  row.Name,
+			Sales: row.Sales,
 		})
-
-		modelSalesByModel[chair.Model] += sales
+		modelSalesByModel[row.Model] += row.Sales
 	}
 
-	models := []modelSales{}
 	for model, sales := range modelSalesByModel {
-		models = append(models, modelSales{
+		res.Models = append(res.Models, modelSales{
 			Model: model,
 			Sales: sales,
 		})
 	}
-	res.Models = models
+	sort.Slice(res.Models, func(i, j int) bool {
+		return res.Models[i].Model < res.Models[j].Model
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetSalesTimeseriesResponse struct {
+	Bucket  string                                  `json:"bucket"`
+	TZ      string                                  `json:"tz"`
+	Buckets []ownerGetSalesTimeseriesResponseBucket `json:"buckets"`
+}
+
+type ownerGetSalesTimeseriesResponseBucket struct {
+	Start         int64                                  `json:"start"`
+	Sales         int                                    `json:"sales"`
+	RidesCount    int                                    `json:"rides_count"`
+	EvaluationAvg float64                                `json:"evaluation_avg"`
+	Distance      int                                    `json:"distance"`
+	Chairs        []ownerGetSalesTimeseriesResponseChair `json:"chairs"`
+}
+
+type ownerGetSalesTimeseriesResponseChair struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Sales         int     `json:"sales"`
+	RidesCount    int     `json:"rides_count"`
+	EvaluationAvg float64 `json:"evaluation_avg"`
+	Distance      int     `json:"distance"`
+}
+
+// ownerGetSalesTimeseries は chair_sales_hourly を指定した単位・タイムゾーンでまとめ直して返す。
+// 集計は1時間単位なので、UTCからのオフセットが1時間単位でないタイムゾーンでは境界がずれる
+func ownerGetSalesTimeseries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseTimeRangeQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = "day"
+	}
+	if bucket != "hour" && bucket != "day" && bucket != "week" {
+		writeError(w, http.StatusBadRequest, errors.New("bucket must be one of hour, day, week"))
+		return
+	}
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("tz is invalid"))
+		return
+	}
+
+	rows := []struct {
+		ChairID       string    `db:"chair_id"`
+		ChairName     string    `db:"chair_name"`
+		BucketStart   time.Time `db:"bucket_start"`
+		Sales         int       `db:"sales"`
+		RidesCount    int       `db:"rides_count"`
+		EvaluationSum int       `db:"evaluation_sum"`
+		Distance      int       `db:"distance"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT h.chair_id, c.name AS chair_name, h.bucket_start, h.sales, h.rides_count, h.evaluation_sum, h.distance
+		 FROM chair_sales_hourly h INNER JOIN chairs c ON c.id = h.chair_id
+		 WHERE c.owner_id = ? AND h.bucket_start BETWEEN ? AND ?
+		 ORDER BY h.bucket_start, h.chair_id`,
+		owner.ID, since.UTC().Truncate(time.Hour), until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	type aggregate struct {
+		name          string
+		sales         int
+		ridesCount    int
+		evaluationSum int
+		distance      int
+	}
+	evaluationAvg := func(a *aggregate) float64 {
+		if a.ridesCount == 0 {
+			return 0
+		}
+		return float64(a.evaluationSum) / float64(a.ridesCount)
+	}
+
+	// rows はバケットの開始時刻順なので、まとめ直した後もその順序が保たれる
+	bucketStarts := []time.Time{}
+	totals := map[time.Time]*aggregate{}
+	chairIDsByBucket := map[time.Time][]string{}
+	chairsByBucket := map[time.Time]map[string]*aggregate{}
+	for _, row := range rows {
+		start := truncateToBucket(row.BucketStart, bucket, loc)
+		if _, ok := totals[start]; !ok {
+			bucketStarts = append(bucketStarts, start)
+			totals[start] = &aggregate{}
+			chairsByBucket[start] = map[string]*aggregate{}
+		}
+		chair, ok := chairsByBucket[start][row.ChairID]
+		if !ok {
+			chair = &aggregate{name: row.ChairName}
+			chairsByBucket[start][row.ChairID] = chair
+			chairIDsByBucket[start] = append(chairIDsByBucket[start], row.ChairID)
+		}
+		for _, a := range []*aggregate{totals[start], chair} {
+			a.sales += row.Sales
+			a.ridesCount += row.RidesCount
+			a.evaluationSum += row.EvaluationSum
+			a.distance += row.Distance
+		}
+	}
+
+	res := ownerGetSalesTimeseriesResponse{
+		Bucket:  bucket,
+		TZ:      tz,
+		Buckets: []ownerGetSalesTimeseriesResponseBucket{},
+	}
+	for _, start := range bucketStarts {
+		total := totals[start]
+		b := ownerGetSalesTimeseriesResponseBucket{
+			Start:         start.UnixMilli(),
+			Sales:         total.sales,
+			RidesCount:    total.ridesCount,
+			EvaluationAvg: evaluationAvg(total),
+			Distance:      total.distance,
+			Chairs:        []ownerGetSalesTimeseriesResponseChair{},
+		}
+		chairIDs := chairIDsByBucket[start]
+		sort.Strings(chairIDs)
+		for _, chairID := range chairIDs {
+			chair := chairsByBucket[start][chairID]
+			b.Chairs = append(b.Chairs, ownerGetSalesTimeseriesResponseChair{
+				ID:            chairID,
+				Name:          chair.name,
+				Sales:         chair.sales,
+				RidesCount:    chair.ridesCount,
+				EvaluationAvg: evaluationAvg(chair),
+				Distance:      chair.distance,
+			})
+		}
+		res.Buckets = append(res.Buckets, b)
+	}
 
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
+type ownerRideLedgerRow struct {
+	RideID               string    `db:"ride_id" json:"ride_id"`
+	ChairID              string    `db:"chair_id" json:"chair_id"`
+	ChairName            string    `db:"chair_name" json:"chair_name"`
+	PickupLatitude       int       `db:"pickup_latitude" json:"pickup_latitude"`
+	PickupLongitude      int       `db:"pickup_longitude" json:"pickup_longitude"`
+	DestinationLatitude  int       `db:"destination_latitude" json:"destination_latitude"`
+	DestinationLongitude int       `db:"destination_longitude" json:"destination_longitude"`
+	Distance             int       `db:"distance" json:"distance"`
+	Pooled               bool      `db:"pooled" json:"-"`
+	Fare                 int       `db:"-" json:"fare"`
+	Discount             int       `db:"-" json:"discount"`
+	ChargedAmount        int       `db:"-" json:"charged_amount"`
+	RefundedAmount       int       `db:"refunded_amount" json:"refunded_amount"`
+	Evaluation           *int      `db:"evaluation" json:"evaluation"`
+	RequestedAt          time.Time `db:"requested_at" json:"-"`
+	CompletedAt          time.Time `db:"completed_at" json:"-"`
+	RequestedAtMs        int64     `db:"-" json:"requested_at"`
+	CompletedAtMs        int64     `db:"-" json:"completed_at"`
+
+	CouponDiscount int  `db:"coupon_discount" json:"-"`
+	PaymentAmount  *int `db:"payment_amount" json:"-"`
+}
+
+var ownerRideLedgerCSVHeader = []string{
+	"ride_id", "chair_id", "chair_name",
+	"pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude",
+	"distance", "fare", "discount", "charged_amount", "refunded_amount", "evaluation",
+	"requested_at", "completed_at",
+}
+
+func (row *ownerRideLedgerRow) csvRecord() []string {
+	evaluation := ""
+	if row.Evaluation != nil {
+		evaluation = strconv.Itoa(*row.Evaluation)
+	}
+	return []string{
+		row.RideID, row.ChairID, row.ChairName,
+		strconv.Itoa(row.PickupLatitude), strconv.Itoa(row.PickupLongitude), strconv.Itoa(row.DestinationLatitude), strconv.Itoa(row.DestinationLongitude),
+		strconv.Itoa(row.Distance), strconv.Itoa(row.Fare), strconv.Itoa(row.Discount), strconv.Itoa(row.ChargedAmount), strconv.Itoa(row.RefundedAmount), evaluation,
+		strconv.FormatInt(row.RequestedAtMs, 10), strconv.FormatInt(row.CompletedAtMs, 10),
 	}
-	return sale
 }
 
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+// ownerGetRidesExport はオーナーの椅子が期間内に完了したライドを1行ずつ書き出す。
+// 期間が長くてもメモリに載せないよう、DBから読みながらそのままレスポンスに流す
+func ownerGetRidesExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseTimeRangeQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be one of csv, jsonl"))
+		return
+	}
+
+	rows, err := db.QueryxContext(
+		ctx,
+		`SELECT r.id AS ride_id, r.chair_id, c.name AS chair_name,
+		        r.pickup_latitude, r.pickup_longitude, r.destination_latitude, r.destination_longitude, r.distance, r.pooled,
+		        r.evaluation, r.created_at AS requested_at, rs.created_at AS completed_at,
+		        COALESCE(cp.discount, 0) AS coupon_discount, p.amount AS payment_amount,
+		        CAST(COALESCE((SELECT SUM(rf.amount) FROM ride_refunds rf WHERE rf.ride_id = r.id AND rf.status = 'COMPLETED'), 0) AS SIGNED) AS refunded_amount
+		 FROM chairs c
+		 INNER JOIN rides r ON r.chair_id = c.id
+		 INNER JOIN ride_statuses rs ON rs.ride_id = r.id AND rs.status = 'COMPLETED'
+		 LEFT JOIN ride_payments p ON p.ride_id = r.id
+		 LEFT JOIN coupons cp ON cp.used_by = r.id
+		 WHERE c.owner_id = ? AND rs.created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		 ORDER BY rs.created_at, r.id`,
+		owner.ID, since, until,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	flusher, _ := w.(http.Flusher)
+	var csvWriter *csv.Writer
+	var jsonEncoder *json.Encoder
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv;charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="rides.csv"`)
+		w.WriteHeader(http.StatusOK)
+		csvWriter = csv.NewWriter(w)
+		csvWriter.Write(ownerRideLedgerCSVHeader)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson;charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="rides.jsonl"`)
+		w.WriteHeader(http.StatusOK)
+		jsonEncoder = json.NewEncoder(w)
+	}
+
+	// ヘッダーを送った後はステータスコードを変えられないので、途中のエラーはログに残して打ち切る
+	written := 0
+	for rows.Next() {
+		row := ownerRideLedgerRow{}
+		if err := rows.StructScan(&row); err != nil {
+			slog.Error("failed to scan ride ledger row", "error", err)
+			return
+		}
+		row.Fare = initialFare + farePerDistance*row.Distance
+		// 実際の値引き額は決済額から求める
+		row.ChargedAmount = chargedFare(row.Distance, row.Pooled, row.CouponDiscount, row.PaymentAmount)
+		row.Discount = row.Fare - row.ChargedAmount
+		row.RequestedAtMs = row.RequestedAt.UnixMilli()
+		row.CompletedAtMs = row.CompletedAt.UnixMilli()
+
+		if csvWriter != nil {
+			err = csvWriter.Write(row.csvRecord())
+		} else {
+			err = jsonEncoder.Encode(&row)
+		}
+		if err != nil {
+			slog.Error("failed to write ride ledger row", "error", err)
+			return
+		}
+
+		written++
+		if written%100 == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read ride ledger rows", "error", err)
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
 }
 
 type chairWithDetail struct {
 	ID                     string     `db:"id"`
 	OwnerID                string     `db:"owner_id"`
 	Name                   string     `db:"name"`
-	AccessToken            string     `db:"access_token"`
 	Model                  string     `db:"model"`
 	IsActive               bool       `db:"is_active"`
 	CreatedAt              time.Time  `db:"created_at"`
 	UpdatedAt              time.Time  `db:"updated_at"`
 	TotalDistance          int        `db:"total_distance"`
 	TotalDistanceUpdatedAt *time.Time `db:"total_distance_updated_at"`
+	RetiredAt              *time.Time `db:"retired_at"`
+	OfflineAt              *time.Time `db:"offline_at"`
+	DeactivatedByOwner     bool       `db:"deactivated_by_owner"`
 }
 
 type ownerGetChairResponse struct {
@@ -187,6 +746,11 @@ type ownerGetChairResponseChair struct {
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	RetiredAt              *int64 `json:"retired_at,omitempty"`
+	// 連絡が途絶えてマッチングの対象から外した日時
+	OfflineAt *int64 `json:"offline_at,omitempty"`
+	// オーナーが強制的に配車受付停止にしているかどうか
+	DeactivatedByOwner bool `json:"deactivated_by_owner"`
 }
 
 func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
@@ -194,26 +758,756 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	owner := ctx.Value("owner").(*Owner)
 
 	chairs := []chairWithDetail{}
-	if err := db.SelectContext(ctx, &chairs, `SELECT id, owner_id, name, access_token, model, is_active, created_at, updated_at, total_distance, total_distance_updated_at FROM chairs WHERE owner_id = ?`, owner.ID); err != nil {
+	if err := db.SelectContext(ctx, &chairs, `SELECT id, owner_id, name, model, is_active, created_at, updated_at, total_distance, total_distance_updated_at, retired_at, offline_at, deactivated_by_owner FROM chairs WHERE owner_id = ?`, owner.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	res := ownerGetChairResponse{}
+	res := ownerGetChairResponse{
+		Chairs: []ownerGetChairResponseChair{},
+	}
 	for _, chair := range chairs {
 		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: chair.TotalDistance,
+			ID:                 chair.ID,
+			Name:               chair.Name,
+			Model:              chair.Model,
+			Active:             chair.IsActive,
+			RegisteredAt:       chair.CreatedAt.UnixMilli(),
+			TotalDistance:      chair.TotalDistance,
+			DeactivatedByOwner: chair.DeactivatedByOwner,
 		}
 		if chair.TotalDistanceUpdatedAt != nil {
 			t := chair.TotalDistanceUpdatedAt.UnixMilli()
 			c.TotalDistanceUpdatedAt = &t
 		}
+		if chair.RetiredAt != nil {
+			t := chair.RetiredAt.UnixMilli()
+			c.RetiredAt = &t
+		}
+		if chair.OfflineAt != nil {
+			t := chair.OfflineAt.UnixMilli()
+			c.OfflineAt = &t
+		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerGetChairDetailResponse struct {
+	ID                     string                               `json:"id"`
+	Name                   string                               `json:"name"`
+	Model                  string                               `json:"model"`
+	Active                 bool                                 `json:"active"`
+	RegisteredAt           int64                                `json:"registered_at"`
+	TotalDistance          int                                  `json:"total_distance"`
+	TotalDistanceUpdatedAt *int64                               `json:"total_distance_updated_at,omitempty"`
+	RetiredAt              *int64                               `json:"retired_at,omitempty"`
+	OfflineAt              *int64                               `json:"offline_at,omitempty"`
+	DeactivatedByOwner     bool                                 `json:"deactivated_by_owner"`
+	CurrentLocation        *ownerGetChairDetailResponseLocation `json:"current_location"`
+	CurrentRide            *ownerGetChairDetailResponseRide     `json:"current_ride"`
+	TotalRidesCount        int                                  `json:"total_rides_count"`
+	TotalEvaluationAvg     float64                              `json:"total_evaluation_avg"`
+	TagCounts              map[string]int                       `json:"tag_counts"`
+	Windows                []ownerGetChairDetailResponseWindow  `json:"windows"`
+}
+
+type ownerGetChairDetailResponseLocation struct {
+	Latitude  int   `json:"latitude"`
+	Longitude int   `json:"longitude"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type ownerGetChairDetailResponseRide struct {
+	ID                    string     `json:"id"`
+	Status                string     `json:"status"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	RequestedAt           int64      `json:"requested_at"`
+}
+
+type ownerGetChairDetailResponseWindow struct {
+	Window      string  `json:"window"`
+	Since       int64   `json:"since"`
+	Sales       int     `json:"sales"`
+	RidesCount  int     `json:"rides_count"`
+	RideTime    int64   `json:"ride_time"`
+	ActiveTime  int64   `json:"active_time"`
+	Utilization float64 `json:"utilization"`
+}
+
+// 集計期間を指定しなかったときは直近1日・1週間・30日の3つを返す
+const defaultChairDetailWindows = "24h,7d,30d"
+
+// parseChairDetailWindows は "24h,7d" のようなカンマ区切りの期間を解釈する。time.ParseDuration の書式に加えて日単位の "d" を受け付ける
+func parseChairDetailWindows(s string) ([]string, []time.Duration, error) {
+	names := strings.Split(s, ",")
+	if len(names) > 10 {
+		return nil, nil, errors.New("too many windows")
+	}
+	durations := make([]time.Duration, 0, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		names[i] = name
+		var d time.Duration
+		if days, ok := strings.CutSuffix(name, "d"); ok {
+			n, err := strconv.Atoi(days)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid window: %s", name)
+			}
+			d = time.Duration(n) * 24 * time.Hour
+		} else {
+			parsed, err := time.ParseDuration(name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid window: %s", name)
+			}
+			d = parsed
+		}
+		if d <= 0 {
+			return nil, nil, fmt.Errorf("invalid window: %s", name)
+		}
+		durations = append(durations, d)
+	}
+	return names, durations, nil
+}
+
+type timeInterval struct {
+	start time.Time
+	end   time.Time
+}
+
+// overlap は区間のうち [since, until) に含まれる長さを返す
+func (i timeInterval) overlap(since, until time.Time) time.Duration {
+	start, end := i.start, i.end
+	if start.Before(since) {
+		start = since
+	}
+	if end.After(until) {
+		end = until
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// chairActiveIntervals は椅子が配車受付状態だった区間を返す。
+// chair_activities は状態の変更を記録したものなので、最初の記録より前はその逆の状態だったとみなす。
+// 一度も記録が無い椅子 (初期データなど) は登録時から現在の状態が続いているとみなす
+func chairActiveIntervals(chair *Chair, activities []ChairActivity, now time.Time) []timeInterval {
+	intervals := []timeInterval{}
+	active := chair.IsActive
+	if len(activities) > 0 {
+		active = !activities[0].IsActive
+	}
+	var activeSince time.Time
+	if active {
+		activeSince = chair.CreatedAt
+	}
+	for _, activity := range activities {
+		if activity.IsActive == active {
+			continue
+		}
+		if active {
+			intervals = append(intervals, timeInterval{start: activeSince, end: activity.CreatedAt})
+		} else {
+			activeSince = activity.CreatedAt
+		}
+		active = activity.IsActive
+	}
+	if active {
+		intervals = append(intervals, timeInterval{start: activeSince, end: now})
+	}
+	return intervals
+}
+
+// ownerGetChairDetail はオーナーの椅子1台の現在の状態と、期間ごとの売上・稼働率を返す
+func ownerGetChairDetail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+
+	windows := r.URL.Query().Get("windows")
+	if windows == "" {
+		windows = defaultChairDetailWindows
+	}
+	windowNames, windowDurations, err := parseChairDetailWindows(windows)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := authorizeChair(ctx, tx, chairID, actionChairRead, false)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	now := time.Now()
+	res := ownerGetChairDetailResponse{
+		ID:                 chair.ID,
+		Name:               chair.Name,
+		Model:              chair.Model,
+		Active:             chair.IsActive,
+		RegisteredAt:       chair.CreatedAt.UnixMilli(),
+		TotalDistance:      chair.TotalDistance,
+		DeactivatedByOwner: chair.DeactivatedByOwner,
+		Windows:            []ownerGetChairDetailResponseWindow{},
+	}
+	if chair.TotalDistanceUpdatedAt != nil {
+		t := chair.TotalDistanceUpdatedAt.UnixMilli()
+		res.TotalDistanceUpdatedAt = &t
+	}
+	if chair.RetiredAt != nil {
+		t := chair.RetiredAt.UnixMilli()
+		res.RetiredAt = &t
+	}
+	if chair.OfflineAt != nil {
+		t := chair.OfflineAt.UnixMilli()
+		res.OfflineAt = &t
+	}
+	if chair.LatestLatitude != nil && chair.LatestLongitude != nil && chair.LatestLocationUpdatedAt != nil {
+		res.CurrentLocation = &ownerGetChairDetailResponseLocation{
+			Latitude:  *chair.LatestLatitude,
+			Longitude: *chair.LatestLongitude,
+			UpdatedAt: chair.LatestLocationUpdatedAt.UnixMilli(),
+		}
+	}
+
+	ride := &Ride{}
+	if err := tx.GetContext(
+		ctx,
+		ride,
+		`SELECT *, latest_status FROM rides WHERE chair_id = ? AND (latest_status IS NULL OR latest_status NOT IN ('COMPLETED', 'CANCELED')) ORDER BY updated_at DESC LIMIT 1`,
+		chair.ID,
+	); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		status := "MATCHING"
+		if ride.LatestStatus.Valid {
+			status = ride.LatestStatus.String
+		}
+		res.CurrentRide = &ownerGetChairDetailResponseRide{
+			ID:     ride.ID,
+			Status: status,
+			PickupCoordinate: Coordinate{
+				Latitude:  ride.PickupLatitude,
+				Longitude: ride.PickupLongitude,
+			},
+			DestinationCoordinate: Coordinate{
+				Latitude:  ride.DestinationLatitude,
+				Longitude: ride.DestinationLongitude,
+			},
+			RequestedAt: ride.CreatedAt.UnixMilli(),
+		}
+	}
+
+	stats, err := getChairStats(ctx, tx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res.TotalRidesCount = stats.TotalRidesCount
+	res.TotalEvaluationAvg = stats.TotalEvaluationAvg
+	tagCounts, err := getChairReviewTagCounts(ctx, tx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res.TagCounts = tagCounts
+
+	oldest := now
+	for _, d := range windowDurations {
+		if since := now.Add(-d); since.Before(oldest) {
+			oldest = since
+		}
+	}
+
+	// 迎車を始めてから目的地に到着するまでをライド中の時間とする
+	rideTimes := []struct {
+		StartedAt time.Time  `db:"started_at"`
+		ArrivedAt *time.Time `db:"arrived_at"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&rideTimes,
+		`SELECT MIN(CASE WHEN rs.status = 'ENROUTE' THEN rs.created_at END) AS started_at,
+		        MIN(CASE WHEN rs.status = 'ARRIVED' THEN rs.created_at END) AS arrived_at
+		 FROM rides r
+		 INNER JOIN ride_statuses rs ON rs.ride_id = r.id
+		 WHERE r.chair_id = ? AND (r.updated_at >= ? OR r.latest_status IS NULL OR r.latest_status NOT IN ('COMPLETED', 'CANCELED'))
+		 GROUP BY r.id
+		 HAVING started_at IS NOT NULL`,
+		chair.ID, oldest,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rideIntervals := make([]timeInterval, 0, len(rideTimes))
+	for _, rt := range rideTimes {
+		end := now
+		if rt.ArrivedAt != nil {
+			end = *rt.ArrivedAt
+		}
+		rideIntervals = append(rideIntervals, timeInterval{start: rt.StartedAt, end: end})
+	}
+
+	activities := []ChairActivity{}
+	if err := tx.SelectContext(ctx, &activities, `SELECT * FROM chair_activities WHERE chair_id = ? ORDER BY created_at`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	activeIntervals := chairActiveIntervals(chair, activities, now)
+
+	for i, d := range windowDurations {
+		since := now.Add(-d)
+
+		// 売上は ownerGetSales と同じく、期間内に完了したライドの実際の決済額から返金額を引いたもの
+		sales := struct {
+			Sales      int `db:"sales"`
+			RidesCount int `db:"rides_count"`
+		}{}
+		if err := tx.GetContext(
+			ctx,
+			&sales,
+			`SELECT CAST(COALESCE(SUM(p.amount - COALESCE(rf.amount, 0)), 0) AS SIGNED) AS sales, COUNT(*) AS rides_count
+			 FROM rides r
+			 INNER JOIN ride_statuses rs ON rs.ride_id = r.id AND rs.status = 'COMPLETED'
+			 INNER JOIN ride_payments p ON p.ride_id = r.id
+			 LEFT JOIN (SELECT ride_id, SUM(amount) AS amount FROM ride_refunds WHERE status = 'COMPLETED' GROUP BY ride_id) rf ON rf.ride_id = r.id
+			 WHERE r.chair_id = ? AND rs.created_at BETWEEN ? AND ?`,
+			chair.ID, since, now,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		var rideTime, activeTime time.Duration
+		for _, interval := range rideIntervals {
+			rideTime += interval.overlap(since, now)
+		}
+		for _, interval := range activeIntervals {
+			activeTime += interval.overlap(since, now)
+		}
+		utilization := 0.0
+		if activeTime > 0 {
+			// 配車受付を止めた後も実行中のライドは続くので、1を超えないように丸める
+			utilization = min(float64(rideTime)/float64(activeTime), 1)
+		}
+
+		res.Windows = append(res.Windows, ownerGetChairDetailResponseWindow{
+			Window:      windowNames[i],
+			Since:       since.UnixMilli(),
+			Sales:       sales.Sales,
+			RidesCount:  sales.RidesCount,
+			RideTime:    rideTime.Milliseconds(),
+			ActiveTime:  activeTime.Milliseconds(),
+			Utilization: utilization,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetChairReviewsResponse struct {
+	Reviews   []ownerGetChairReviewsResponseReview `json:"reviews"`
+	TagCounts map[string]int                       `json:"tag_counts"`
+	// 続きがあるときだけ返す。次のページを取得するときに cursor に指定する
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type ownerGetChairReviewsResponseReview struct {
+	RideID     string   `json:"ride_id"`
+	Evaluation int      `json:"evaluation"`
+	Comment    string   `json:"comment"`
+	Tags       []string `json:"tags"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+// ownerGetChairReviews は椅子の評価に添えられたコメントとタグを新しい順に cursor (ライドID) より古いものから limit 件ずつ返す
+func ownerGetChairReviews(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+
+	page, err := parsePageParams(r, pageDefaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := authorizeChair(ctx, tx, chairID, actionChairRead, false)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	reviews := []struct {
+		RideReview
+		Evaluation int `db:"evaluation"`
+	}{}
+	// 続きがあるかどうかを知るために1件多く取得する
+	if err := tx.SelectContext(
+		ctx,
+		&reviews,
+		`SELECT rv.*, r.evaluation FROM ride_reviews rv INNER JOIN rides r ON r.id = rv.ride_id
+		 WHERE rv.chair_id = ? AND (? = '' OR rv.ride_id < ?)
+		 ORDER BY rv.ride_id DESC
+		 LIMIT ?`,
+		chair.ID, page.Cursor, page.Cursor, page.Limit+1,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tagCounts, err := getChairReviewTagCounts(ctx, tx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetChairReviewsResponse{
+		Reviews:   []ownerGetChairReviewsResponseReview{},
+		TagCounts: tagCounts,
+	}
+	if len(reviews) > page.Limit {
+		reviews = reviews[:page.Limit]
+		res.NextCursor = reviews[page.Limit-1].RideID
+	}
+	for _, review := range reviews {
+		tags := []string{}
+		if review.Tags != "" {
+			tags = strings.Split(review.Tags, ",")
+		}
+		res.Reviews = append(res.Reviews, ownerGetChairReviewsResponseReview{
+			RideID:     review.RideID,
+			Evaluation: review.Evaluation,
+			Comment:    review.Comment,
+			Tags:       tags,
+			CreatedAt:  review.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetChairAnomaliesResponse struct {
+	Anomalies []ownerGetChairAnomaliesResponseAnomaly `json:"anomalies"`
+	// 続きがあるときだけ返す。次のページを取得するときに cursor に指定する
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type ownerGetChairAnomaliesResponseAnomaly struct {
+	ID                 string     `json:"id"`
+	PreviousCoordinate Coordinate `json:"previous_coordinate"`
+	Coordinate         Coordinate `json:"coordinate"`
+	Distance           int        `json:"distance"`
+	MaxDistance        int        `json:"max_distance"`
+	Rejected           bool       `json:"rejected"`
+	CreatedAt          int64      `json:"created_at"`
+}
+
+// ownerGetChairAnomalies は椅子から送られた位置の異常を新しい順に cursor (異常のID) より古いものから limit 件ずつ返す
+func ownerGetChairAnomalies(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+
+	page, err := parsePageParams(r, pageDefaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := authorizeChair(ctx, tx, chairID, actionChairRead, false)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	anomalies := []ChairLocationAnomaly{}
+	// 続きがあるかどうかを知るために1件多く取得する
+	if err := tx.SelectContext(
+		ctx,
+		&anomalies,
+		`SELECT * FROM chair_location_anomalies
+		 WHERE chair_id = ? AND (? = '' OR id < ?)
+		 ORDER BY id DESC
+		 LIMIT ?`,
+		chair.ID, page.Cursor, page.Cursor, page.Limit+1,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetChairAnomaliesResponse{
+		Anomalies: []ownerGetChairAnomaliesResponseAnomaly{},
+	}
+	if len(anomalies) > page.Limit {
+		anomalies = anomalies[:page.Limit]
+		res.NextCursor = anomalies[page.Limit-1].ID
+	}
+	for _, anomaly := range anomalies {
+		res.Anomalies = append(res.Anomalies, ownerGetChairAnomaliesResponseAnomaly{
+			ID:                 anomaly.ID,
+			PreviousCoordinate: Coordinate{Latitude: anomaly.PreviousLatitude, Longitude: anomaly.PreviousLongitude},
+			Coordinate:         Coordinate{Latitude: anomaly.Latitude, Longitude: anomaly.Longitude},
+			Distance:           anomaly.Distance,
+			MaxDistance:        anomaly.MaxDistance,
+			Rejected:           anomaly.Rejected,
+			CreatedAt:          anomaly.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetNotificationsResponse struct {
+	Notifications []ownerGetNotificationsResponseNotification `json:"notifications"`
+	// 続きがあるときだけ返す。次のページを取得するときに cursor に指定する
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type ownerGetNotificationsResponseNotification struct {
+	ID                   string `json:"id"`
+	Type                 string `json:"type"`
+	ChairID              string `json:"chair_id"`
+	ReassignedRidesCount int    `json:"reassigned_rides_count"`
+	CreatedAt            int64  `json:"created_at"`
+}
+
+// ownerGetNotifications はオーナーへのお知らせを新しい順に cursor (お知らせのID) より古いものから limit 件ずつ返す
+func ownerGetNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	page, err := parsePageParams(r, pageDefaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	notifications := []OwnerNotification{}
+	// 続きがあるかどうかを知るために1件多く取得する
+	if err := db.SelectContext(
+		ctx,
+		&notifications,
+		`SELECT * FROM owner_notifications
+		 WHERE owner_id = ? AND (? = '' OR id < ?)
+		 ORDER BY id DESC
+		 LIMIT ?`,
+		owner.ID, page.Cursor, page.Cursor, page.Limit+1,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetNotificationsResponse{
+		Notifications: []ownerGetNotificationsResponseNotification{},
+	}
+	if len(notifications) > page.Limit {
+		notifications = notifications[:page.Limit]
+		res.NextCursor = notifications[page.Limit-1].ID
+	}
+	for _, notification := range notifications {
+		res.Notifications = append(res.Notifications, ownerGetNotificationsResponseNotification{
+			ID:                   notification.ID,
+			Type:                 notification.Type,
+			ChairID:              notification.ChairID,
+			ReassignedRidesCount: notification.ReassignedRidesCount,
+			CreatedAt:            notification.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPatchChairRequest struct {
+	Name *string `json:"name"`
+	// false なら椅子を強制的に配車受付停止にし、椅子からは配車受付を再開できなくする。
+	// true なら強制的な停止を解除して、椅子から配車受付を再開できるようにする
+	Active *bool `json:"active"`
+}
+
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name != nil && (*req.Name == "" || utf8.RuneCountInString(*req.Name) > 30) {
+		writeError(w, http.StatusBadRequest, errors.New("name must be 1 to 30 characters"))
+		return
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := authorizeChair(ctx, tx, chairID, actionChairUpdate, true)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if chair.RetiredAt != nil {
+		writeError(w, http.StatusConflict, errors.New("chair is retired"))
+		return
+	}
+
+	if req.Name != nil {
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET name = ? WHERE id = ?`, *req.Name, chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if req.Active != nil && !*req.Active {
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET is_active = FALSE, deactivated_by_owner = TRUE WHERE id = ?`, chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if chair.IsActive {
+			if err := recordChairActivity(ctx, tx, chair.ID, false); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+	if req.Active != nil && *req.Active {
+		// 配車受付を再開するかどうかは椅子に任せる
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET deactivated_by_owner = FALSE WHERE id = ?`, chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownerDeleteChair は椅子を引退させる。ライドの履歴や売上に残るので行は消さずに retired_at を記録する
+func ownerDeleteChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := authorizeChair(ctx, tx, chairID, actionChairRetire, true)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if chair.RetiredAt != nil {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	continuingRideCount := 0
+	if err := tx.GetContext(ctx, &continuingRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND (latest_status IS NULL OR latest_status NOT IN ('COMPLETED', 'CANCELED'))`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if continuingRideCount > 0 {
+		writeError(w, http.StatusConflict, errors.New("chair has a ride in progress"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE chairs SET is_active = FALSE, retired_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordChairActivity(ctx, tx, chair.ID, false); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := revokeSessionsOf(ctx, tx, sessionRoleChair, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	invalidateSessionCacheOf(sessionRoleChair, chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ownerPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &postRideRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride, status, err := authorizeRide(ctx, tx, rideID, actionRideRefund, true)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	reservation, status, err := reserveRideRefund(ctx, tx, ride, req, refundRequestedByOwner, &owner.ID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, status, err := completeRideRefund(ctx, reservation)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, res)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// 一覧APIで limit を省略した場合の件数
+	pageDefaultLimit = 20
+	// 一覧APIで一度に取得できる件数の上限
+	pageMaxLimit = 100
+)
+
+// pageParams は新しい順に並べた一覧を ULID のカーソルでページングするためのクエリパラメータ
+type pageParams struct {
+	// このIDより古いものを返す。空なら最新のものから返す
+	Cursor string
+	Limit  int
+}
+
+// parsePageParams はクエリパラメータの cursor と limit を解釈する。limit を省略した場合は defaultLimit になる
+func parsePageParams(r *http.Request, defaultLimit int) (pageParams, error) {
+	query := r.URL.Query()
+	page := pageParams{
+		Cursor: query.Get("cursor"),
+		Limit:  defaultLimit,
+	}
+	if page.Cursor != "" {
+		if _, err := ulid.ParseStrict(page.Cursor); err != nil {
+			return page, errors.New("invalid cursor")
+		}
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > pageMaxLimit {
+			return page, errors.New("limit must be between 1 and 100")
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
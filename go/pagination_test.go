@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePageParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    pageParams
+		wantErr bool
+	}{
+		{query: "", want: pageParams{Limit: pageDefaultLimit}},
+		{query: "limit=1", want: pageParams{Limit: 1}},
+		{query: "limit=100", want: pageParams{Limit: 100}},
+		{query: "cursor=01JDFEDF00B09BNMV8MP0RB34G&limit=5", want: pageParams{Cursor: "01JDFEDF00B09BNMV8MP0RB34G", Limit: 5}},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=101", wantErr: true},
+		{query: "limit=abc", wantErr: true},
+		{query: "cursor=not-a-ulid", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+			got, err := parsePageParams(r, pageDefaultLimit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePageParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parsePageParams() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,26 +7,40 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 )
 
 var erroredUpstream = errors.New("errored upstream")
 
+// 決済マイクロサービスが 4xx で返金を断った。リトライしても結果は変わらない
+var errPaymentGatewayRefundRejected = errors.New("refund rejected by payment gateway")
+
 type paymentGatewayPostPaymentRequest struct {
 	Amount int `json:"amount"`
 }
 
+type paymentGatewayPostPaymentResponse struct {
+	ID string `json:"id"`
+}
+
 type paymentGatewayGetPaymentsResponseOne struct {
+	// 決済IDを返さない決済マイクロサービスもあるので空の場合がある
+	ID     string `json:"id"`
 	Amount int    `json:"amount"`
 	Status string `json:"status"`
 }
 
-func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
+// requestPaymentGatewayPostPayment は決済を行い、決済マイクロサービスが返した決済IDを返す。
+// 決済IDが分からなかった場合は空文字列を返す
+func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) (string, error) {
 	b, err := json.Marshal(param)
 	if err != nil {
-		return err
+		return "", err
 	}
 
+	paymentID := ""
+
 	// 失敗したらとりあえずリトライ
 	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
 	retry := 0
@@ -45,6 +59,15 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 			}
 			defer res.Body.Close()
 
+			if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated {
+				var payment paymentGatewayPostPaymentResponse
+				if err := json.NewDecoder(res.Body).Decode(&payment); err != nil {
+					return err
+				}
+				paymentID = payment.ID
+				return nil
+			}
+
 			if res.StatusCode != http.StatusNoContent {
 				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
 				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
@@ -77,6 +100,10 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 					return fmt.Errorf("unexpected number of payments: %d != %d. %w", len(rides), len(payments), erroredUpstream)
 				}
 
+				// 件数が一致しているなら最後の決済が今回の決済
+				if len(payments) > 0 {
+					paymentID = payments[len(payments)-1].ID
+				}
 				return nil
 			}
 			return nil
@@ -87,11 +114,74 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 				time.Sleep(100 * time.Millisecond)
 				continue
 			} else {
+				return "", err
+			}
+		}
+		break
+	}
+
+	return paymentID, nil
+}
+
+type paymentGatewayPostRefundRequest struct {
+	Amount int `json:"amount"`
+}
+
+type paymentGatewayPostRefundResponse struct {
+	ID string `json:"id"`
+}
+
+// requestPaymentGatewayPostRefund は決済を返金し、決済マイクロサービスが返した返金IDを返す。
+// 同じ idempotencyKey の返金は一度しか行われないので、通信エラーと 5xx はリトライする。
+// 4xx は返金額の超過や存在しない決済などリトライしても変わらないので、すぐに errPaymentGatewayRefundRejected を返す
+func requestPaymentGatewayPostRefund(ctx context.Context, paymentGatewayURL string, token string, paymentID string, idempotencyKey string, param *paymentGatewayPostRefundRequest) (string, error) {
+	b, err := json.Marshal(param)
+	if err != nil {
+		return "", err
+	}
+
+	refundID := ""
+	retry := 0
+	for {
+		err := func() error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments/"+url.PathEscape(paymentID)+"/refund", bytes.NewBuffer(b))
+			if err != nil {
 				return err
 			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode >= 400 && res.StatusCode < 500 {
+				return fmt.Errorf("[POST /payments/%s/refund] unexpected status code (%d). %w", paymentID, res.StatusCode, errPaymentGatewayRefundRejected)
+			}
+			if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+				return fmt.Errorf("[POST /payments/%s/refund] unexpected status code (%d). %w", paymentID, res.StatusCode, erroredUpstream)
+			}
+			var refund paymentGatewayPostRefundResponse
+			if err := json.NewDecoder(res.Body).Decode(&refund); err != nil {
+				return err
+			}
+			refundID = refund.ID
+			return nil
+		}()
+		if err != nil {
+			if !errors.Is(err, errPaymentGatewayRefundRejected) && retry < 5 {
+				retry++
+				time.Sleep(100 * time.Millisecond)
+				continue
+			} else {
+				return "", err
+			}
 		}
 		break
 	}
 
-	return nil
+	return refundID, nil
 }
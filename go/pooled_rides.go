@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 相乗りのライドを同時に受け持てる数
+var pooledRideCapacity = envInt("ISUCON_POOLED_RIDE_CAPACITY", 2, 1)
+
+// 相乗りのライドを追加で受け持つことで、すでに受け持っているライドの経路が延びてよい距離
+var pooledRideMaxDetour = envInt("ISUCON_POOLED_RIDE_MAX_DETOUR", 30, 0)
+
+// 相乗りのライドは距離に応じた運賃をこの割合(%)だけ割り引く
+const pooledRideDiscountPercent = 20
+
+// 相乗りのライドを追加で受け持てるのは、受け持っているライドが全てこの状態の間だけ
+var poolableRideStatuses = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING"}
+
+// pooledRider は相乗りの椅子が受け持つライドのうち、まだ回っていない停車地
+type pooledRider struct {
+	// 乗車済みなら nil
+	Pickup      *Coordinate
+	Destination Coordinate
+}
+
+func newPooledRider(ride *Ride) pooledRider {
+	rider := pooledRider{
+		Destination: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+	}
+	if !ride.LatestStatus.Valid || ride.LatestStatus.String != "CARRYING" {
+		rider.Pickup = &Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	}
+	return rider
+}
+
+// pooledStop は相乗りの椅子が回る停車地
+type pooledStop struct {
+	Coordinate
+	Rider  int
+	Pickup bool
+}
+
+// planPooledRoute は椅子の現在位置 from から、残っている停車地のうち最も近いものを順に回る経路を作る。
+// 乗車前の利用者は配車位置を回ってから目的地を回る
+func planPooledRoute(from Coordinate, riders []pooledRider) []pooledStop {
+	remaining := []pooledStop{}
+	for i, rider := range riders {
+		if rider.Pickup != nil {
+			remaining = append(remaining, pooledStop{Coordinate: *rider.Pickup, Rider: i, Pickup: true})
+		}
+	}
+	pickedUp := make([]bool, len(riders))
+	for i, rider := range riders {
+		pickedUp[i] = rider.Pickup == nil
+		remaining = append(remaining, pooledStop{Coordinate: rider.Destination, Rider: i})
+	}
+
+	route := make([]pooledStop, 0, len(remaining))
+	current := from
+	for len(remaining) > 0 {
+		next := -1
+		for i, stop := range remaining {
+			if !stop.Pickup && !pickedUp[stop.Rider] {
+				continue
+			}
+			if next < 0 || calculateDistance(current.Latitude, current.Longitude, stop.Latitude, stop.Longitude) <
+				calculateDistance(current.Latitude, current.Longitude, remaining[next].Latitude, remaining[next].Longitude) {
+				next = i
+			}
+		}
+		stop := remaining[next]
+		if stop.Pickup {
+			pickedUp[stop.Rider] = true
+		}
+		route = append(route, stop)
+		current = stop.Coordinate
+		remaining = slices.Delete(remaining, next, next+1)
+	}
+	return route
+}
+
+// pooledRideDetours は planPooledRoute の経路で、利用者ごとに目的地に着くまでの距離が、
+// 椅子が今から1人だけを乗せて配車位置と目的地に直行する場合より延びる距離を求める。乗車済みの利用者は目的地に直行する場合と比べる
+func pooledRideDetours(from Coordinate, riders []pooledRider) []int {
+	detours := make([]int, len(riders))
+	traveled := 0
+	current := from
+	for _, stop := range planPooledRoute(from, riders) {
+		traveled += calculateDistance(current.Latitude, current.Longitude, stop.Latitude, stop.Longitude)
+		current = stop.Coordinate
+		if stop.Pickup {
+			continue
+		}
+		rider := riders[stop.Rider]
+		detours[stop.Rider] = traveled - calculateRouteDistance(from, nil, rider.Destination)
+		if rider.Pickup != nil {
+			detours[stop.Rider] = traveled - calculateRouteDistance(from, []Coordinate{*rider.Pickup}, rider.Destination)
+		}
+	}
+	return detours
+}
+
+// pooledChairAccepts は相乗りのライド rides を受け持っている椅子が、さらに ride を受け持てるかどうかを返す。
+// 椅子の現在位置から全ての利用者の残りの停車地を回る経路で、新しい利用者も含めて誰の経路も pooledRideMaxDetour より延びない場合だけ受け持てる
+func pooledChairAccepts(chair *Chair, rides []Ride, ride *Ride) bool {
+	if chair.LatestLatitude == nil || chair.LatestLongitude == nil || len(rides) == 0 || len(rides) >= pooledRideCapacity {
+		return false
+	}
+	riders := make([]pooledRider, 0, len(rides)+1)
+	for i := range rides {
+		if !rides[i].Pooled || !rides[i].LatestStatus.Valid || !slices.Contains(poolableRideStatuses, rides[i].LatestStatus.String) {
+			return false
+		}
+		riders = append(riders, newPooledRider(&rides[i]))
+	}
+	riders = append(riders, newPooledRider(ride))
+
+	from := Coordinate{Latitude: *chair.LatestLatitude, Longitude: *chair.LatestLongitude}
+	for _, detour := range pooledRideDetours(from, riders) {
+		if detour > pooledRideMaxDetour {
+			return false
+		}
+	}
+	return true
+}
+
+// 椅子が受け持っている、完了もキャンセルもされていないライド
+const unfinishedRidesOfChairsQuery = `SELECT *, latest_status, pooled FROM rides WHERE chair_id IN (?) AND (latest_status IS NULL OR latest_status NOT IN ('COMPLETED', 'CANCELED'))`
+
+// findPooledChair は相乗りのライドを受け持っていて、ride をさらに受け持てる椅子のうち配車位置に最も近いものを返す。
+// 見つからなければ nil を返す
+func findPooledChair(ctx context.Context, tx sqlx.QueryerContext, ride *Ride) (*Chair, error) {
+	candidates := []Chair{}
+	if err := sqlx.SelectContext(
+		ctx,
+		tx,
+		&candidates,
+		`SELECT c.*, c.latest_latitude, c.latest_longitude
+		 FROM chairs c
+		 WHERE c.is_active = TRUE
+		 AND c.retired_at IS NULL
+		 AND c.offline_at IS NULL
+		 AND c.deactivated_by_owner = FALSE
+		 AND c.latest_latitude IS NOT NULL
+		 AND c.latest_longitude IS NOT NULL
+		 AND EXISTS (SELECT 1 FROM rides r WHERE r.chair_id = c.id AND r.pooled = TRUE AND r.latest_status IN ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING'))
+		 ORDER BY
+			(c.latest_latitude - ?) * (c.latest_latitude - ?) +
+			(c.latest_longitude - ?) * (c.latest_longitude - ?)`,
+		ride.PickupLatitude, ride.PickupLatitude,
+		ride.PickupLongitude, ride.PickupLongitude,
+	); err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	chairIDs := make([]string, len(candidates))
+	for i := range candidates {
+		chairIDs[i] = candidates[i].ID
+	}
+	query, args, err := sqlx.In(unfinishedRidesOfChairsQuery, chairIDs)
+	if err != nil {
+		return nil, err
+	}
+	rides := []Ride{}
+	if err := sqlx.SelectContext(ctx, tx, &rides, query, args...); err != nil {
+		return nil, err
+	}
+	ridesByChair := map[string][]Ride{}
+	for _, r := range rides {
+		ridesByChair[r.ChairID.String] = append(ridesByChair[r.ChairID.String], r)
+	}
+
+	for i := range candidates {
+		if pooledChairAccepts(&candidates[i], ridesByChair[candidates[i].ID], ride) {
+			return &candidates[i], nil
+		}
+	}
+	return nil, nil
+}
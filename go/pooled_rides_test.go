@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+)
+
+func TestPooledRideDetours(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   Coordinate
+		riders []pooledRider
+		want   []int
+	}{
+		{
+			name: "same direction",
+			from: Coordinate{Latitude: 0, Longitude: 0},
+			riders: []pooledRider{
+				{Pickup: &Coordinate{Latitude: 0, Longitude: 0}, Destination: Coordinate{Latitude: 10, Longitude: 0}},
+				{Pickup: &Coordinate{Latitude: 2, Longitude: 0}, Destination: Coordinate{Latitude: 8, Longitude: 0}},
+			},
+			want: []int{0, 0},
+		},
+		{
+			name: "carrying rider is compared from the current location",
+			from: Coordinate{Latitude: 5, Longitude: 0},
+			riders: []pooledRider{
+				{Destination: Coordinate{Latitude: 10, Longitude: 0}},
+				{Pickup: &Coordinate{Latitude: 5, Longitude: 3}, Destination: Coordinate{Latitude: 10, Longitude: 3}},
+			},
+			// 5,0 -> 5,3 -> 10,3 -> 10,0 の順に回るので、乗車済みの利用者は直行する 5 より 6 延びる
+			want: []int{6, 0},
+		},
+		{
+			name: "new rider is also detoured",
+			from: Coordinate{Latitude: 0, Longitude: 0},
+			riders: []pooledRider{
+				{Pickup: &Coordinate{Latitude: 1, Longitude: 0}, Destination: Coordinate{Latitude: 3, Longitude: 0}},
+				{Pickup: &Coordinate{Latitude: 2, Longitude: 0}, Destination: Coordinate{Latitude: 0, Longitude: 0}},
+			},
+			// 0,0 -> 1,0 -> 2,0 -> 3,0 -> 0,0 の順に回るので、2人目は 3,0 を経由する
+			want: []int{0, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pooledRideDetours(tt.from, tt.riders); !slices.Equal(got, tt.want) {
+				t.Errorf("pooledRideDetours() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPooledChairAccepts(t *testing.T) {
+	latitude, longitude := 0, 0
+	chair := &Chair{ID: "chair1", LatestLatitude: &latitude, LatestLongitude: &longitude}
+	pooledRide := func(status string, pickup, destination Coordinate) Ride {
+		return Ride{
+			Pooled:               true,
+			LatestStatus:         sql.NullString{String: status, Valid: true},
+			PickupLatitude:       pickup.Latitude,
+			PickupLongitude:      pickup.Longitude,
+			DestinationLatitude:  destination.Latitude,
+			DestinationLongitude: destination.Longitude,
+		}
+	}
+	near := pooledRide("MATCHING", Coordinate{Latitude: 1, Longitude: 0}, Coordinate{Latitude: 9, Longitude: 0})
+	far := pooledRide("MATCHING", Coordinate{Latitude: 0, Longitude: 20}, Coordinate{Latitude: 0, Longitude: 40})
+
+	tests := []struct {
+		name  string
+		rides []Ride
+		ride  Ride
+		want  bool
+	}{
+		{
+			name:  "close route",
+			rides: []Ride{pooledRide("ENROUTE", Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 0})},
+			ride:  near,
+			want:  true,
+		},
+		{
+			name:  "far route",
+			rides: []Ride{pooledRide("ENROUTE", Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: 100, Longitude: 0})},
+			ride:  far,
+			want:  false,
+		},
+		{
+			name:  "not pooled",
+			rides: []Ride{{LatestStatus: sql.NullString{String: "ENROUTE", Valid: true}}},
+			ride:  near,
+			want:  false,
+		},
+		{
+			name:  "no rides",
+			rides: nil,
+			ride:  near,
+			want:  false,
+		},
+		{
+			name: "full",
+			rides: []Ride{
+				pooledRide("ENROUTE", Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 0}),
+				pooledRide("MATCHING", Coordinate{Latitude: 1, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 0}),
+			},
+			ride: near,
+			want: pooledRideCapacity > 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pooledChairAccepts(chair, tt.rides, &tt.ride); got != tt.want {
+				t.Errorf("pooledChairAccepts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	refundRequestedByOwner = "OWNER"
+	refundRequestedByAdmin = "ADMIN"
+)
+
+type postRideRefundRequest struct {
+	// 省略された場合は未返金の残額をすべて返金する
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type postRideRefundResponse struct {
+	ID             string `json:"id"`
+	RideID         string `json:"ride_id"`
+	Amount         int    `json:"amount"`
+	ChargedAmount  int    `json:"charged_amount"`
+	RefundedAmount int    `json:"refunded_amount"`
+}
+
+// rideRefundReservation は返金履歴に PENDING で記録した、決済マイクロサービスでの返金を待っている返金
+type rideRefundReservation struct {
+	ID                string
+	RideID            string
+	ChairID           string
+	Amount            int
+	ChargedAmount     int
+	RefundedAmount    int
+	PaymentGatewayURL string
+	PaymentToken      string
+	GatewayPaymentID  string
+}
+
+// reserveRideRefund は完了済みライドの返金額を確かめ、返金履歴に PENDING で記録する。
+// 決済マイクロサービスへの返金は tx をコミットしてから completeRideRefund で行う。
+// 失敗した場合はレスポンスに使うステータスコードとエラーを返す
+func reserveRideRefund(ctx context.Context, tx *sqlx.Tx, ride *Ride, req *postRideRefundRequest, requestedBy string, requesterID *string) (*rideRefundReservation, int, error) {
+	if req.Amount < 0 {
+		return nil, http.StatusBadRequest, errors.New("amount must not be negative")
+	}
+	if len(req.Reason) > 255 {
+		return nil, http.StatusBadRequest, errors.New("reason is too long")
+	}
+	if !ride.LatestStatus.Valid || ride.LatestStatus.String != "COMPLETED" {
+		return nil, http.StatusBadRequest, errors.New("ride is not completed")
+	}
+
+	payment := &RidePayment{}
+	if err := tx.GetContext(ctx, payment, `SELECT * FROM ride_payments WHERE ride_id = ? FOR UPDATE`, ride.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusConflict, errors.New("payment of this ride is not recorded")
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	// 初期データのライドは決済マイクロサービス上の決済IDが分からないので、決済マイクロサービスで返金できない
+	if payment.GatewayPaymentID == nil {
+		return nil, http.StatusConflict, errors.New("this ride was paid before payment ids were recorded and cannot be refunded through the payment gateway")
+	}
+
+	// 返金中のものも、二重に返金しないよう返金済みとして扱う
+	refunded := 0
+	if err := tx.GetContext(ctx, &refunded, `SELECT COALESCE(SUM(amount), 0) FROM ride_refunds WHERE ride_id = ? AND status <> 'FAILED'`, ride.ID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	remaining := payment.Amount - refunded
+	if remaining <= 0 {
+		return nil, http.StatusConflict, errors.New("already fully refunded")
+	}
+	amount := req.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		return nil, http.StatusBadRequest, fmt.Errorf("amount exceeds refundable amount (%d)", remaining)
+	}
+
+	var paymentGatewayURL string
+	if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	refundID := ulid.Make().String()
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ride_refunds (id, ride_id, amount, reason, requested_by, requester_id, status) VALUES (?, ?, ?, ?, ?, ?, 'PENDING')`,
+		refundID, ride.ID, amount, req.Reason, requestedBy, requesterID,
+	); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &rideRefundReservation{
+		ID:                refundID,
+		RideID:            ride.ID,
+		ChairID:           ride.ChairID.String,
+		Amount:            amount,
+		ChargedAmount:     payment.Amount,
+		RefundedAmount:    refunded,
+		PaymentGatewayURL: paymentGatewayURL,
+		PaymentToken:      payment.Token,
+		GatewayPaymentID:  *payment.GatewayPaymentID,
+	}, 0, nil
+}
+
+// completeRideRefund は reserveRideRefund で記録した返金を決済マイクロサービスで行い、返金履歴を完了にする。
+// 返金IDを冪等キーとして渡すので、リトライしても二重に返金されない。
+// 失敗した場合はレスポンスに使うステータスコードとエラーを返す
+func completeRideRefund(ctx context.Context, reservation *rideRefundReservation) (*postRideRefundResponse, int, error) {
+	gatewayRefundID, err := requestPaymentGatewayPostRefund(ctx, reservation.PaymentGatewayURL, reservation.PaymentToken, reservation.GatewayPaymentID, reservation.ID, &paymentGatewayPostRefundRequest{
+		Amount: reservation.Amount,
+	})
+	// 決済マイクロサービスで返金が済んだら、リクエストが切断されても返金履歴に反映する
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		if errors.Is(err, errPaymentGatewayRefundRejected) {
+			// 決済マイクロサービスが返金を断ったので、返金できる残額に戻す
+			if _, err := db.ExecContext(ctx, `UPDATE ride_refunds SET status = 'FAILED' WHERE id = ?`, reservation.ID); err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			return nil, http.StatusBadGateway, err
+		}
+		// 返金されたか分からないので PENDING のまま残し、返金できる残額からは差し引いたままにする
+		if errors.Is(err, erroredUpstream) {
+			return nil, http.StatusBadGateway, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE ride_refunds SET status = 'COMPLETED', gateway_refund_id = ? WHERE id = ?`, gatewayRefundID, reservation.ID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// 返金額はライドが完了した時間帯の売上から差し引く
+	var completedAt time.Time
+	if err := tx.GetContext(ctx, &completedAt, `SELECT created_at FROM ride_statuses WHERE ride_id = ? AND status = 'COMPLETED' ORDER BY created_at LIMIT 1`, reservation.RideID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := addChairSalesRollup(ctx, tx, reservation.ChairID, completedAt, chairSalesRollupDelta{
+		Sales: -reservation.Amount,
+	}); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &postRideRefundResponse{
+		ID:             reservation.ID,
+		RideID:         reservation.RideID,
+		Amount:         reservation.Amount,
+		ChargedAmount:  reservation.ChargedAmount,
+		RefundedAmount: reservation.RefundedAmount + reservation.Amount,
+	}, 0, nil
+}
+
+// getRefundedAmounts はライドIDごとの返金額の合計を返す
+func getRefundedAmounts(ctx context.Context, tx *sqlx.Tx, rideIDs []string) (map[string]int, error) {
+	refunded := map[string]int{}
+	if len(rideIDs) == 0 {
+		return refunded, nil
+	}
+
+	query, args, err := sqlx.In(`SELECT ride_id, SUM(amount) AS amount FROM ride_refunds WHERE ride_id IN (?) AND status = 'COMPLETED' GROUP BY ride_id`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		RideID string `db:"ride_id"`
+		Amount int    `db:"amount"`
+	}{}
+	if err := tx.SelectContext(ctx, &rows, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		refunded[row.RideID] = row.Amount
+	}
+	return refunded, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 評価に付けられるタグ。並び順はレスポンスのタグの並び順にもなる
+var reviewTags = []string{"clean", "fast", "comfortable", "safe", "friendly", "quiet"}
+
+const reviewCommentMaxLength = 500
+
+// コメントに含められない語。大文字小文字は区別しない。
+// 前後に同じ種類の文字 (英数字、ひらがな、カタカナ、漢字) が続く場合は、別の語の一部 (カスタム、乗りにくそう など) とみなして弾かない
+var reviewProfanities = []string{
+	"fuck", "fucking", "fucked", "shit", "shitty", "bitch", "asshole", "bastard",
+	"クソ", "くそ", "カス", "ゴミ",
+}
+
+// コメントに含められない語句。活用して後ろに語が続くことが多いので、どこに現れても弾く
+var reviewProfanityPhrases = []string{"死ね", "殺す"}
+
+// 弾く語を含むが、それだけで問題のない語。判定の前に取り除く
+var reviewProfanityExceptions = []string{"ゴミ箱", "ゴミ袋", "ゴミ捨て", "ゴミ出し", "必死"}
+
+// 文字の種類。語の区切りの判定に使う
+type scriptClass int
+
+const (
+	scriptOther scriptClass = iota
+	scriptAlnum
+	scriptHiragana
+	scriptKatakana
+	scriptHan
+)
+
+func scriptClassOf(r rune) scriptClass {
+	switch {
+	case unicode.Is(unicode.Hiragana, r):
+		return scriptHiragana
+	case unicode.Is(unicode.Katakana, r) || r == 'ー':
+		return scriptKatakana
+	case unicode.Is(unicode.Han, r):
+		return scriptHan
+	case unicode.IsLetter(r) || unicode.IsDigit(r):
+		return scriptAlnum
+	}
+	return scriptOther
+}
+
+// containsProfanity はコメントに reviewProfanities の語が1つの語として含まれるか、reviewProfanityPhrases の語句が含まれるかどうかを返す
+func containsProfanity(comment string) bool {
+	lower := strings.ToLower(comment)
+	for _, exception := range reviewProfanityExceptions {
+		lower = strings.ReplaceAll(lower, exception, " ")
+	}
+	for _, phrase := range reviewProfanityPhrases {
+		if strings.Contains(lower, phrase) {
+			return true
+		}
+	}
+	for _, word := range reviewProfanities {
+		first, _ := utf8.DecodeRuneInString(word)
+		last, _ := utf8.DecodeLastRuneInString(word)
+		for offset := 0; ; {
+			i := strings.Index(lower[offset:], word)
+			if i < 0 {
+				break
+			}
+			start, end := offset+i, offset+i+len(word)
+			before, _ := utf8.DecodeLastRuneInString(lower[:start])
+			after, _ := utf8.DecodeRuneInString(lower[end:])
+			if (start == 0 || scriptClassOf(before) != scriptClassOf(first)) &&
+				(end == len(lower) || scriptClassOf(after) != scriptClassOf(last)) {
+				return true
+			}
+			offset = start + len(string(first))
+		}
+	}
+	return false
+}
+
+// validateReview は評価に添えるコメントとタグを検証する
+func validateReview(comment string, tags []string) error {
+	if utf8.RuneCountInString(comment) > reviewCommentMaxLength {
+		return fmt.Errorf("comment must be at most %d characters", reviewCommentMaxLength)
+	}
+	if containsProfanity(comment) {
+		return errors.New("comment contains inappropriate words")
+	}
+	for i, tag := range tags {
+		if !slices.Contains(reviewTags, tag) {
+			return fmt.Errorf("invalid tag: %s", tag)
+		}
+		if slices.Contains(tags[:i], tag) {
+			return fmt.Errorf("duplicated tag: %s", tag)
+		}
+	}
+	return nil
+}
+
+// sortReviewTags はタグを reviewTags の順に並べる
+func sortReviewTags(tags []string) []string {
+	sorted := make([]string, 0, len(tags))
+	for _, tag := range reviewTags {
+		if slices.Contains(tags, tag) {
+			sorted = append(sorted, tag)
+		}
+	}
+	return sorted
+}
+
+// createRideReview はライドの評価に添えられたコメントとタグを保存し、椅子ごとのタグの集計を更新する
+func createRideReview(ctx context.Context, tx sqlx.ExecerContext, ride *Ride, comment string, tags []string) error {
+	if comment == "" && len(tags) == 0 {
+		return nil
+	}
+	tags = sortReviewTags(tags)
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ride_reviews (ride_id, chair_id, comment, tags) VALUES (?, ?, ?, ?)`,
+		ride.ID, ride.ChairID.String, comment, strings.Join(tags, ","),
+	); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO chair_review_tag_counts (chair_id, tag, count) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE count = count + 1`,
+			ride.ChairID.String, tag,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getChairReviewTagCounts は椅子が評価で付けられたタグの回数を返す。付けられていないタグも 0 として含める
+func getChairReviewTagCounts(ctx context.Context, tx *sqlx.Tx, chairID string) (map[string]int, error) {
+	rows := []struct {
+		Tag   string `db:"tag"`
+		Count int    `db:"count"`
+	}{}
+	if err := tx.SelectContext(ctx, &rows, `SELECT tag, count FROM chair_review_tag_counts WHERE chair_id = ?`, chairID); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(reviewTags))
+	for _, tag := range reviewTags {
+		counts[tag] = 0
+	}
+	for _, row := range rows {
+		counts[row.Tag] = row.Count
+	}
+	return counts, nil
+}
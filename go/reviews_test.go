@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestContainsProfanity(t *testing.T) {
+	tests := []struct {
+		comment string
+		want    bool
+	}{
+		{comment: "", want: false},
+		{comment: "快適でした", want: false},
+		{comment: "This is shit", want: true},
+		{comment: "FUCK", want: true},
+		{comment: "what a fucking ride!", want: true},
+		{comment: "shiitake mushrooms", want: false},
+		{comment: "Scunthorpe bitcoin", want: false},
+		{comment: "クソ", want: true},
+		{comment: "この椅子はクソ", want: true},
+		{comment: "クソ野郎", want: true},
+		{comment: "最悪、カス。", want: true},
+		{comment: "ゴミ椅子だった", want: true},
+		{comment: "死ね", want: true},
+		{comment: "運転手は死ね", want: true},
+		{comment: "殺すぞ", want: true},
+		{comment: "運転手死ね", want: true},
+		{comment: "カスタムされた椅子", want: false},
+		{comment: "カスタマーサポートが丁寧", want: false},
+		{comment: "ゴミ箱が付いていて便利", want: false},
+		{comment: "ゴミ袋を持ってきてくれた", want: false},
+		{comment: "くそう、遅刻した", want: false},
+		{comment: "少し乗りにくそうだった", want: false},
+		{comment: "必死ね、運転手さん", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.comment, func(t *testing.T) {
+			if got := containsProfanity(tt.comment); got != tt.want {
+				t.Errorf("containsProfanity(%q) = %v, want %v", tt.comment, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReview(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment string
+		tags    []string
+		wantErr bool
+	}{
+		{name: "empty", wantErr: false},
+		{name: "comment and tags", comment: "カスタムの座面が快適", tags: []string{"clean", "fast"}, wantErr: false},
+		{name: "max length", comment: strings.Repeat("あ", reviewCommentMaxLength), wantErr: false},
+		{name: "too long", comment: strings.Repeat("あ", reviewCommentMaxLength+1), wantErr: true},
+		{name: "profanity", comment: "クソ遅い", wantErr: true},
+		{name: "invalid tag", tags: []string{"dirty"}, wantErr: true},
+		{name: "duplicated tag", tags: []string{"safe", "safe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateReview(tt.comment, tt.tags); (err != nil) != tt.wantErr {
+				t.Errorf("validateReview() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSortReviewTags(t *testing.T) {
+	got := sortReviewTags([]string{"quiet", "clean", "safe"})
+	want := []string{"clean", "safe", "quiet"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sortReviewTags() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// chairSalesRollupDelta は chair_sales_hourly に加算する値
+type chairSalesRollupDelta struct {
+	Sales         int
+	RidesCount    int
+	EvaluationSum int
+	Distance      int
+}
+
+// addChairSalesRollup はライドが完了した時間帯の椅子の売上集計に加算する。
+// ライドの完了時と返金時に、それらを記録するトランザクションの中で呼ぶこと
+func addChairSalesRollup(ctx context.Context, tx sqlx.ExecerContext, chairID string, completedAt time.Time, delta chairSalesRollupDelta) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_hourly (chair_id, bucket_start, sales, rides_count, evaluation_sum, distance) VALUES (?, ?, ?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE
+		   sales = sales + VALUES(sales),
+		   rides_count = rides_count + VALUES(rides_count),
+		   evaluation_sum = evaluation_sum + VALUES(evaluation_sum),
+		   distance = distance + VALUES(distance)`,
+		chairID, completedAt.UTC().Truncate(time.Hour), delta.Sales, delta.RidesCount, delta.EvaluationSum, delta.Distance,
+	)
+	return err
+}
+
+// truncateToBucket は時刻を指定したタイムゾーンでの集計単位の開始時刻に切り捨てる。週は月曜始まり
+func truncateToBucket(t time.Time, bucket string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch bucket {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const sessionCacheTTL = 5 * time.Minute
+
+// アクセストークンから認証主体 (User, Owner, Chair) のIDを引くためのキャッシュ
+// トークンそのものではなく、sessions.token と同じハッシュをキーにして保持する。
+// 認証主体の名前や状態は書き換わるので、IDだけをキャッシュして行は毎回読み込む
+var (
+	appSessionCache   = newSessionCache(sessionRoleApp)
+	ownerSessionCache = newSessionCache(sessionRoleOwner)
+	chairSessionCache = newSessionCache(sessionRoleChair)
+)
+
+type sessionCacheEntry struct {
+	principalID string
+	expiresAt   time.Time
+}
+
+type sessionCache struct {
+	mu      sync.RWMutex
+	role    string
+	entries map[string]sessionCacheEntry
+	// 認証主体のIDからキーを引くための索引。無効化に使う
+	keysByID map[string]map[string]struct{}
+}
+
+func newSessionCache(role string) *sessionCache {
+	return &sessionCache{
+		role:     role,
+		entries:  map[string]sessionCacheEntry{},
+		keysByID: map[string]map[string]struct{}{},
+	}
+}
+
+// get は有効期限内のキャッシュがあれば認証主体のIDを返す
+func (c *sessionCache) get(accessToken string) (string, bool) {
+	key := hashToken(accessToken)
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	if now := time.Now(); now.After(entry.expiresAt) {
+		// 期限切れのキャッシュは見つけた時点で破棄する
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok && now.After(entry.expiresAt) {
+			c.deleteLocked(key, entry)
+		}
+		c.mu.Unlock()
+		return "", false
+	}
+	return entry.principalID, true
+}
+
+// set は認証主体のIDをキャッシュする。セッションの有効期限を過ぎてキャッシュが使われることはない
+func (c *sessionCache) set(tokenHash string, principalID string, sessionExpiresAt time.Time) {
+	key := tokenHash
+	expiresAt := time.Now().Add(sessionCacheTTL)
+	if sessionExpiresAt.Before(expiresAt) {
+		expiresAt = sessionExpiresAt
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = sessionCacheEntry{
+		principalID: principalID,
+		expiresAt:   expiresAt,
+	}
+	if _, ok := c.keysByID[principalID]; !ok {
+		c.keysByID[principalID] = map[string]struct{}{}
+	}
+	c.keysByID[principalID][key] = struct{}{}
+}
+
+// invalidate は指定したアクセストークンのキャッシュを破棄する
+func (c *sessionCache) invalidate(accessToken string) {
+	key := hashToken(accessToken)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.deleteLocked(key, entry)
+}
+
+// deleteLocked はキャッシュを索引ごと破棄する。c.mu のロックを取ってから呼ぶこと
+func (c *sessionCache) deleteLocked(key string, entry sessionCacheEntry) {
+	delete(c.entries, key)
+	delete(c.keysByID[entry.principalID], key)
+	if len(c.keysByID[entry.principalID]) == 0 {
+		delete(c.keysByID, entry.principalID)
+	}
+}
+
+// sweep は期限切れのキャッシュをすべて破棄する
+func (c *sessionCache) sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			c.deleteLocked(key, entry)
+		}
+	}
+}
+
+// invalidateByID は指定した認証主体のキャッシュをすべて破棄する
+func (c *sessionCache) invalidateByID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.keysByID[id] {
+		delete(c.entries, key)
+	}
+	delete(c.keysByID, id)
+}
+
+func (c *sessionCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]sessionCacheEntry{}
+	c.keysByID = map[string]map[string]struct{}{}
+}
+
+// lookup はキャッシュから認証主体のIDを引き、無ければ有効なセッションをDBから読み込んでキャッシュする。
+// 有効なセッションが無ければ sql.ErrNoRows を返す
+func (c *sessionCache) lookup(ctx context.Context, accessToken string) (string, error) {
+	if principalID, ok := c.get(accessToken); ok {
+		return principalID, nil
+	}
+	tokenHash := hashToken(accessToken)
+	session := struct {
+		PrincipalID string    `db:"principal_id"`
+		ExpiresAt   time.Time `db:"expires_at"`
+	}{}
+	if err := db.GetContext(
+		ctx,
+		&session,
+		`SELECT principal_id, expires_at FROM sessions WHERE token = ? AND role = ? AND revoked_at IS NULL AND expires_at > ?`,
+		tokenHash, c.role, time.Now(),
+	); err != nil {
+		return "", err
+	}
+	c.set(tokenHash, session.PrincipalID, session.ExpiresAt)
+	return session.PrincipalID, nil
+}
+
+// sweepSessionCaches は一度も引かれないまま期限が切れたキャッシュが残り続けないよう、一定間隔で破棄する
+func sweepSessionCaches() {
+	ticker := time.NewTicker(sessionCacheTTL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		appSessionCache.sweep(now)
+		ownerSessionCache.sweep(now)
+		chairSessionCache.sweep(now)
+	}
+}
+
+// warmSessionCaches は有効なセッションをすべてDBから読み込んでキャッシュを作り直す
+func warmSessionCaches(ctx context.Context) error {
+	appSessionCache.reset()
+	ownerSessionCache.reset()
+	chairSessionCache.reset()
+
+	sessions := []Session{}
+	if err := db.SelectContext(
+		ctx,
+		&sessions,
+		`SELECT * FROM sessions WHERE revoked_at IS NULL AND expires_at > ?`,
+		time.Now(),
+	); err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		switch s.Role {
+		case sessionRoleApp:
+			appSessionCache.set(s.Token, s.PrincipalID, s.ExpiresAt)
+		case sessionRoleOwner:
+			ownerSessionCache.set(s.Token, s.PrincipalID, s.ExpiresAt)
+		case sessionRoleChair:
+			chairSessionCache.set(s.Token, s.PrincipalID, s.ExpiresAt)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// セッションの有効期間。sql/7-seed-sessions.sql の初期データの有効期限もこれに合わせている
+const sessionTTL = 7 * 24 * time.Hour
+
+const (
+	sessionRoleApp   = "APP"
+	sessionRoleOwner = "OWNER"
+	sessionRoleChair = "CHAIR"
+)
+
+var sessionCookieNames = map[string]string{
+	sessionRoleApp:   "app_session",
+	sessionRoleOwner: "owner_session",
+	sessionRoleChair: "chair_session",
+}
+
+// createSession は発行したアクセストークンのセッションを作成し、有効期限を返す
+func createSession(ctx context.Context, tx sqlx.ExecerContext, role string, principalID string, accessToken string) (time.Time, error) {
+	expiresAt := time.Now().Add(sessionTTL)
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO sessions (token, role, principal_id, expires_at) VALUES (?, ?, ?, ?)`,
+		hashToken(accessToken), role, principalID, expiresAt,
+	); err != nil {
+		return time.Time{}, err
+	}
+	return expiresAt, nil
+}
+
+// revokeSession は指定したアクセストークンのセッションを失効させる
+func revokeSession(ctx context.Context, tx sqlx.ExecerContext, role string, accessToken string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP(6) WHERE token = ? AND role = ? AND revoked_at IS NULL`,
+		hashToken(accessToken), role,
+	)
+	return err
+}
+
+// revokeSessionsOf は指定した認証主体のセッションをすべて失効させる
+func revokeSessionsOf(ctx context.Context, tx sqlx.ExecerContext, role string, principalID string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP(6) WHERE principal_id = ? AND role = ? AND revoked_at IS NULL`,
+		principalID, role,
+	)
+	return err
+}
+
+// invalidateSessionCache はセッションを失効させた後、コミットしてから呼ぶこと
+func invalidateSessionCache(role string, accessToken string) {
+	switch role {
+	case sessionRoleApp:
+		appSessionCache.invalidate(accessToken)
+	case sessionRoleOwner:
+		ownerSessionCache.invalidate(accessToken)
+	case sessionRoleChair:
+		chairSessionCache.invalidate(accessToken)
+	}
+}
+
+// invalidateSessionCacheOf は認証主体のセッションを失効させた後、コミットしてから呼ぶこと
+func invalidateSessionCacheOf(role string, principalID string) {
+	switch role {
+	case sessionRoleApp:
+		appSessionCache.invalidateByID(principalID)
+	case sessionRoleOwner:
+		ownerSessionCache.invalidateByID(principalID)
+	case sessionRoleChair:
+		chairSessionCache.invalidateByID(principalID)
+	}
+}
+
+func setSessionCookie(w http.ResponseWriter, role string, accessToken string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     sessionCookieNames[role],
+		Value:    accessToken,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, role string) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     sessionCookieNames[role],
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type postSessionRotateResponse struct {
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// postSessionLogout は現在のセッションを失効させる。認証ミドルウェアを通した後に呼ぶこと
+func postSessionLogout(w http.ResponseWriter, r *http.Request, role string) {
+	ctx := r.Context()
+	c, err := r.Cookie(sessionCookieNames[role])
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, errors.New(sessionCookieNames[role]+" cookie is required"))
+		return
+	}
+
+	if err := revokeSession(ctx, db, role, c.Value); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	invalidateSessionCache(role, c.Value)
+
+	clearSessionCookie(w, role)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postSessionRotate は現在のセッションを失効させ、新しいアクセストークンを発行する。認証ミドルウェアを通した後に呼ぶこと
+func postSessionRotate(w http.ResponseWriter, r *http.Request, role string, principalID string) {
+	ctx := r.Context()
+	c, err := r.Cookie(sessionCookieNames[role])
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, errors.New(sessionCookieNames[role]+" cookie is required"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := revokeSession(ctx, tx, role, c.Value); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	accessToken := secureRandomStr(32)
+	expiresAt, err := createSession(ctx, tx, role, principalID, accessToken)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	invalidateSessionCache(role, c.Value)
+
+	setSessionCookie(w, role, accessToken, expiresAt)
+	writeJSON(w, http.StatusOK, &postSessionRotateResponse{
+		ExpiresAt: expiresAt.UnixMilli(),
+	})
+}
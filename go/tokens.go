@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"slices"
+	"strings"
+)
+
+// アクセストークンと椅子登録トークンはDBに平文で保存せず、このシークレットを鍵にした HMAC-SHA256 で保存する。
+// 未設定のまま起動すると誰でもハッシュを計算できてしまうので、main で起動を止める
+var tokenHashSecret = []byte(os.Getenv("ISUCON_TOKEN_SECRET"))
+
+// hashToken はDBに保存・照合するためのトークンのハッシュを返す
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, tokenHashSecret)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 初期データのトークンをハッシュ化済みかどうかを settings に記録する
+const tokenHashMigratedSettingName = "token_hash_migrated"
+
+// トークンをハッシュで保存するカラム
+var tokenHashColumns = []struct {
+	table  string
+	column string
+}{
+	{"sessions", "token"},
+	{"chair_register_tokens", "token"},
+}
+
+// migrateTokenHashes は平文で保存されている既存のトークンをハッシュに置き換える。
+// sql/3-initial-data.sql.gz を投入した後に一度だけ実行すればよく、実行済みなら何もしない
+func migrateTokenHashes(ctx context.Context) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	migrated := 0
+	if err := tx.GetContext(ctx, &migrated, `SELECT COUNT(*) FROM settings WHERE name = ? FOR UPDATE`, tokenHashMigratedSettingName); err != nil {
+		return err
+	}
+	if migrated > 0 {
+		return nil
+	}
+
+	// トークンを1クエリでまとめて読み、Go で計算したハッシュを一時テーブルに入れてから、テーブルごとに1回の UPDATE で置き換える
+	tokens := []string{}
+	selects := make([]string, len(tokenHashColumns))
+	for i, column := range tokenHashColumns {
+		selects[i] = "SELECT " + column.column + " AS token FROM " + column.table
+	}
+	if err := tx.SelectContext(ctx, &tokens, strings.Join(selects, " UNION ")); err != nil {
+		return err
+	}
+
+	// 接続に前回の一時テーブルが残っていても作り直せるようにする
+	if _, err := tx.ExecContext(ctx, `DROP TEMPORARY TABLE IF EXISTS token_hashes`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TEMPORARY TABLE token_hashes (token VARCHAR(255) NOT NULL PRIMARY KEY, hash VARCHAR(255) NOT NULL)`); err != nil {
+		return err
+	}
+	type tokenHash struct {
+		Token string `db:"token"`
+		Hash  string `db:"hash"`
+	}
+	for chunk := range slices.Chunk(tokens, 1000) {
+		hashes := make([]tokenHash, len(chunk))
+		for i, token := range chunk {
+			hashes[i] = tokenHash{Token: token, Hash: hashToken(token)}
+		}
+		if _, err := tx.NamedExecContext(ctx, `INSERT INTO token_hashes (token, hash) VALUES (:token, :hash)`, hashes); err != nil {
+			return err
+		}
+	}
+	for _, column := range tokenHashColumns {
+		if _, err := tx.ExecContext(ctx, "UPDATE "+column.table+" t INNER JOIN token_hashes h ON h.token = t."+column.column+" SET t."+column.column+" = h.hash"); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DROP TEMPORARY TABLE token_hashes`); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO settings (name, value) VALUES (?, '1')`, tokenHashMigratedSettingName); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
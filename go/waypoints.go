@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 1つのライドに指定できる経由地の数
+const maxRideWaypoints = 5
+
+// validateWaypoints はライドの依頼や運賃の見積もりで指定された経由地を検証する
+func validateWaypoints(waypoints []Coordinate) error {
+	if len(waypoints) > maxRideWaypoints {
+		return fmt.Errorf("waypoints must be at most %d", maxRideWaypoints)
+	}
+	return nil
+}
+
+// calculateRouteDistance は配車位置から経由地を順に通って目的地まで移動する距離を求める
+func calculateRouteDistance(pickup Coordinate, waypoints []Coordinate, destination Coordinate) int {
+	distance := 0
+	current := pickup
+	for _, waypoint := range waypoints {
+		distance += calculateDistance(current.Latitude, current.Longitude, waypoint.Latitude, waypoint.Longitude)
+		current = waypoint
+	}
+	return distance + calculateDistance(current.Latitude, current.Longitude, destination.Latitude, destination.Longitude)
+}
+
+// createRideWaypoints はライドの経由地を指定された順番で保存する
+func createRideWaypoints(ctx context.Context, tx sqlx.ExecerContext, rideID string, waypoints []Coordinate) error {
+	for i, waypoint := range waypoints {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO ride_waypoints (ride_id, seq, latitude, longitude) VALUES (?, ?, ?, ?)`,
+			rideID, i, waypoint.Latitude, waypoint.Longitude,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRideWaypoints はライドの経由地を経由する順番に返す
+func getRideWaypoints(ctx context.Context, tx sqlx.QueryerContext, rideID string) ([]RideWaypoint, error) {
+	waypoints := []RideWaypoint{}
+	if err := sqlx.SelectContext(ctx, tx, &waypoints, `SELECT * FROM ride_waypoints WHERE ride_id = ? ORDER BY seq`, rideID); err != nil {
+		return nil, err
+	}
+	return waypoints, nil
+}
+
+// rideStop は通知やライドの詳細で返す経由地
+type rideStop struct {
+	Coordinate
+	Reached bool `json:"reached"`
+}
+
+func toRideStops(waypoints []RideWaypoint) []rideStop {
+	stops := make([]rideStop, 0, len(waypoints))
+	for _, waypoint := range waypoints {
+		stops = append(stops, rideStop{
+			Coordinate: Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude},
+			Reached:    waypoint.ReachedAt != nil,
+		})
+	}
+	return stops
+}
@@ -1,26 +1,128 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
+type Payment struct {
+	ID        string    `json:"id"`
+	Amount    int       `json:"amount"`
+	Refunds   []Refund  `json:"refunds"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Refund struct {
+	ID             string    `json:"id"`
+	Amount         int       `json:"amount"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (p *Payment) refundedAmount() int {
+	sum := 0
+	for _, refund := range p.Refunds {
+		sum += refund.Amount
+	}
+	return sum
+}
+
+func (p *Payment) status() string {
+	switch refunded := p.refundedAmount(); {
+	case refunded == 0:
+		return "成功"
+	case refunded < p.Amount:
+		return "一部返金"
+	default:
+		return "返金済み"
+	}
+}
+
 var (
-	data     = map[string][]int{}
+	// 決済トークンごとの決済履歴
+	data     = map[string][]*Payment{}
 	dataLock sync.Mutex
+
+	// 空でなければ決済履歴をこのファイルに永続化する
+	dataFile = os.Getenv("PAYMENT_MOCK_DATA_FILE")
 )
 
 func main() {
+	if err := loadData(); err != nil {
+		slog.Error("決済履歴の読み込みに失敗しました", slog.String("file", dataFile), slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /payments", handleGetPayments)
 	mux.HandleFunc("POST /payments", handlePostPayments)
+	mux.HandleFunc("POST /payments/{payment_id}/refund", handlePostPaymentRefund)
 	http.ListenAndServe(":12345", mux)
 }
 
+// loadData は永続化ファイルがあれば決済履歴を読み込む
+func loadData() error {
+	if dataFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(dataFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	loaded := map[string][]*Payment{}
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		return err
+	}
+	data = loaded
+	return nil
+}
+
+// saveData は決済履歴を永続化ファイルに書き出す。dataLock を取得した状態で呼ぶこと
+func saveData() error {
+	if dataFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	// 書き込み途中で落ちても壊れないように一時ファイルに書いてからリネームする
+	tmp, err := os.CreateTemp(filepath.Dir(dataFile), filepath.Base(dataFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dataFile)
+}
+
+func newID() string {
+	k := make([]byte, 16)
+	if _, err := crand.Read(k); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", k)
+}
+
 type PostPaymentsRequest struct {
 	Amount int `json:"amount"`
 }
@@ -38,28 +140,48 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Amount <= 0 && req.Amount > 1_000_000 {
+	if req.Amount <= 0 || req.Amount > 1_000_000 {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "決済額が不正です"})
 		return
 	}
 
 	// モックサーバーは任意のトークンを受け付けて、決済を記録する
+	payment := &Payment{
+		ID:        newID(),
+		Amount:    req.Amount,
+		Refunds:   []Refund{},
+		CreatedAt: time.Now(),
+	}
 	dataLock.Lock()
-	arr, ok := data[token]
-	if !ok {
-		arr = []int{}
-		data[token] = arr
+	data[token] = append(data[token], payment)
+	if err := saveData(); err != nil {
+		data[token] = data[token][:len(data[token])-1]
+		dataLock.Unlock()
+		slog.Error("決済履歴の保存に失敗しました", slog.Any("error", err))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済履歴の保存に失敗しました"})
+		return
 	}
-	arr = append(arr, req.Amount)
+	res := newResponsePayment(payment)
 	dataLock.Unlock()
 
-	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount))
-	w.WriteHeader(http.StatusNoContent)
+	slog.Info("決済完了", slog.String("token", token), slog.String("id", payment.ID), slog.Int("amount", req.Amount))
+	writeJSON(w, http.StatusOK, res)
 }
 
 type ResponsePayment struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	ID             string `json:"id"`
+	Amount         int    `json:"amount"`
+	RefundedAmount int    `json:"refunded_amount"`
+	Status         string `json:"status"`
+}
+
+func newResponsePayment(p *Payment) ResponsePayment {
+	return ResponsePayment{
+		ID:             p.ID,
+		Amount:         p.Amount,
+		RefundedAmount: p.refundedAmount(),
+		Status:         p.status(),
+	}
 }
 
 func handleGetPayments(w http.ResponseWriter, r *http.Request) {
@@ -70,19 +192,114 @@ func handleGetPayments(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dataLock.Lock()
-	arr, _ := data[token]
-	dataLock.Unlock()
-
+	arr := data[token]
 	res := make([]ResponsePayment, 0, len(arr))
-	for _, amount := range arr {
-		res = append(res, ResponsePayment{
-			Amount: amount,
-			Status: "成功",
-		})
+	for _, payment := range arr {
+		res = append(res, newResponsePayment(payment))
 	}
+	dataLock.Unlock()
+
 	writeJSON(w, http.StatusOK, res)
 }
 
+type PostPaymentRefundRequest struct {
+	// 省略された場合は未返金の残額をすべて返金する
+	Amount int `json:"amount"`
+}
+
+type ResponseRefund struct {
+	ID        string          `json:"id"`
+	Amount    int             `json:"amount"`
+	PaymentID string          `json:"payment_id"`
+	Payment   ResponsePayment `json:"payment"`
+}
+
+func handlePostPaymentRefund(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	paymentID := r.PathValue("payment_id")
+
+	var req PostPaymentRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if req.Amount < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が不正です"})
+		return
+	}
+
+	dataLock.Lock()
+	defer dataLock.Unlock()
+
+	var payment *Payment
+	for _, p := range data[token] {
+		if p.ID == paymentID {
+			payment = p
+			break
+		}
+	}
+	if payment == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "決済が見つかりません"})
+		return
+	}
+
+	// 同じ冪等キーで返金済みなら、返金し直さずに前回の結果を返す
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		for _, refund := range payment.Refunds {
+			if refund.IdempotencyKey == idempotencyKey {
+				writeJSON(w, http.StatusOK, ResponseRefund{
+					ID:        refund.ID,
+					Amount:    refund.Amount,
+					PaymentID: payment.ID,
+					Payment:   newResponsePayment(payment),
+				})
+				return
+			}
+		}
+	}
+
+	remaining := payment.Amount - payment.refundedAmount()
+	amount := req.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if remaining == 0 {
+		writeJSON(w, http.StatusConflict, map[string]string{"message": "すでに全額返金されています"})
+		return
+	}
+	if amount > remaining {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が未返金の残額を超えています"})
+		return
+	}
+
+	refund := Refund{
+		ID:             newID(),
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
+	}
+	payment.Refunds = append(payment.Refunds, refund)
+	if err := saveData(); err != nil {
+		payment.Refunds = payment.Refunds[:len(payment.Refunds)-1]
+		slog.Error("決済履歴の保存に失敗しました", slog.Any("error", err))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済履歴の保存に失敗しました"})
+		return
+	}
+
+	slog.Info("返金完了", slog.String("token", token), slog.String("payment_id", payment.ID), slog.Int("amount", amount))
+	writeJSON(w, http.StatusOK, ResponseRefund{
+		ID:        refund.ID,
+		Amount:    refund.Amount,
+		PaymentID: payment.ID,
+		Payment:   newResponsePayment(payment),
+	})
+}
+
 func getTokenFromAuthorizationHeader(r *http.Request) (string, error) {
 	auth := r.Header.Get("Authorization")
 	if !strings.HasPrefix(auth, "Bearer ") {
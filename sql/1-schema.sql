@@ -29,7 +29,7 @@ CREATE TABLE chairs
   name         VARCHAR(30)  NOT NULL COMMENT '椅子の名前',
   model        TEXT         NOT NULL COMMENT '椅子のモデル',
   is_active    TINYINT(1)   NOT NULL COMMENT '配椅子受付中かどうか',
-  access_token VARCHAR(255) NOT NULL COMMENT 'アクセストークン',
+  access_token VARCHAR(255) NOT NULL COMMENT '初期データのアクセストークン。セッションに移した後 11-drop-legacy-token-columns.sql で削除する',
   created_at   DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
   updated_at   DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
   latest_latitude INTEGER NULL INVISIBLE COMMENT '最新の経度',
@@ -37,6 +37,11 @@ CREATE TABLE chairs
   latest_location_updated_at DATETIME(6) NULL INVISIBLE COMMENT '最新位置の更新日時',
   total_distance INTEGER NOT NULL DEFAULT 0 INVISIBLE COMMENT '総移動距離',
   total_distance_updated_at DATETIME(6) NULL INVISIBLE COMMENT '総移動距離の更新日時',
+  retired_at   DATETIME(6)  NULL INVISIBLE COMMENT 'オーナーが引退させた日時',
+  completed_rides_count INTEGER NOT NULL DEFAULT 0 INVISIBLE COMMENT '完了したライドの数',
+  evaluation_sum INTEGER NOT NULL DEFAULT 0 INVISIBLE COMMENT '完了したライドの評価の合計',
+  offline_at   DATETIME(6)  NULL INVISIBLE COMMENT '連絡が途絶えてマッチングの対象から外した日時',
+  deactivated_by_owner TINYINT(1) NOT NULL DEFAULT FALSE INVISIBLE COMMENT 'オーナーが強制的に配車受付停止にしているかどうか',
   PRIMARY KEY (id)
 )
   COMMENT = '椅子情報テーブル';
@@ -44,6 +49,20 @@ ALTER TABLE chairs ADD INDEX (owner_id);
 ALTER TABLE chairs ADD INDEX (access_token);
 ALTER TABLE chairs ADD INDEX (is_active);
 
+DROP TABLE IF EXISTS owner_notifications;
+CREATE TABLE owner_notifications
+(
+  id                     VARCHAR(26) NOT NULL,
+  owner_id               VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  chair_id               VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  type                   ENUM ('CHAIR_OFFLINE') NOT NULL COMMENT 'お知らせの種類',
+  reassigned_rides_count INTEGER     NOT NULL DEFAULT 0 COMMENT '他の椅子に割り当て直すことにしたライドの数',
+  created_at             DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '通知日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'オーナーへのお知らせテーブル';
+ALTER TABLE owner_notifications ADD INDEX (owner_id, id DESC);
+
 DROP TABLE IF EXISTS chair_locations;
 CREATE TABLE chair_locations
 (
@@ -57,6 +76,36 @@ CREATE TABLE chair_locations
   COMMENT = '椅子の現在位置情報テーブル';
 ALTER TABLE chair_locations ADD INDEX (chair_id, created_at DESC);
 
+DROP TABLE IF EXISTS chair_location_anomalies;
+CREATE TABLE chair_location_anomalies
+(
+  id                 VARCHAR(26) NOT NULL,
+  chair_id           VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  previous_latitude  INTEGER     NOT NULL COMMENT '前回の経度',
+  previous_longitude INTEGER     NOT NULL COMMENT '前回の緯度',
+  latitude           INTEGER     NOT NULL COMMENT '送られた経度',
+  longitude          INTEGER     NOT NULL COMMENT '送られた緯度',
+  distance           INTEGER     NOT NULL COMMENT '前回の位置からの移動距離',
+  max_distance       INTEGER     NOT NULL COMMENT '経過時間と椅子の速度から移動できる距離',
+  rejected           TINYINT(1)  NOT NULL COMMENT '位置を受け付けなかったかどうか',
+  created_at         DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '検知日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '椅子の位置の異常の検知履歴テーブル';
+ALTER TABLE chair_location_anomalies ADD INDEX (chair_id, id DESC);
+
+DROP TABLE IF EXISTS chair_activities;
+CREATE TABLE chair_activities
+(
+  id         VARCHAR(26) NOT NULL,
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  is_active  TINYINT(1)  NOT NULL COMMENT '変更後の配椅子受付状態',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '変更日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '椅子の配椅子受付状態の変更履歴テーブル';
+ALTER TABLE chair_activities ADD INDEX (chair_id, created_at);
+
 DROP TABLE IF EXISTS users;
 CREATE TABLE users
 (
@@ -65,10 +114,12 @@ CREATE TABLE users
   firstname       VARCHAR(30)  NOT NULL COMMENT '本名(名前)',
   lastname        VARCHAR(30)  NOT NULL COMMENT '本名(名字)',
   date_of_birth   VARCHAR(30)  NOT NULL COMMENT '生年月日',
-  access_token    VARCHAR(255) NOT NULL COMMENT 'アクセストークン',
+  access_token    VARCHAR(255) NOT NULL COMMENT '初期データのアクセストークン。セッションに移した後 11-drop-legacy-token-columns.sql で削除する',
   invitation_code VARCHAR(30)  NOT NULL COMMENT '招待トークン',
   created_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
   updated_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  rating_count    INTEGER      NOT NULL DEFAULT 0 INVISIBLE COMMENT '椅子から評価された回数',
+  rating_sum      INTEGER      NOT NULL DEFAULT 0 INVISIBLE COMMENT '椅子からの評価の合計',
   PRIMARY KEY (id),
   UNIQUE (username),
   UNIQUE (access_token),
@@ -82,7 +133,8 @@ CREATE TABLE payment_tokens
   user_id    VARCHAR(26)  NOT NULL COMMENT 'ユーザーID',
   token      VARCHAR(255) NOT NULL COMMENT '決済トークン',
   created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
-  PRIMARY KEY (user_id)
+  is_default TINYINT(1)   NOT NULL DEFAULT FALSE INVISIBLE COMMENT 'デフォルトの決済トークンかどうか',
+  PRIMARY KEY (user_id, token)
 )
   COMMENT = '決済トークンテーブル';
 
@@ -99,7 +151,11 @@ CREATE TABLE rides
   evaluation            INTEGER     NULL     COMMENT '評価',
   created_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '要求日時',
   updated_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '状態更新日時',
-  latest_status         ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NULL INVISIBLE COMMENT '最新状態',
+  latest_status         ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NULL INVISIBLE COMMENT '最新状態',
+  payment_token         VARCHAR(255) NULL INVISIBLE COMMENT 'ライド要求時に選択された決済トークン',
+  scheduled_at          DATETIME(6) NULL INVISIBLE COMMENT '予約された配車日時',
+  distance              INTEGER     NOT NULL DEFAULT 0 INVISIBLE COMMENT '配車位置から経由地を順に通って目的地までの移動距離',
+  pooled                BOOLEAN     NOT NULL DEFAULT FALSE INVISIBLE COMMENT '相乗りを希望したかどうか',
   PRIMARY KEY (id)
 )
   COMMENT = 'ライド情報テーブル';
@@ -109,28 +165,121 @@ ALTER TABLE rides ADD INDEX (user_id, latest_status);
 ALTER TABLE rides ADD INDEX (chair_id, latest_status);
 ALTER TABLE rides ADD INDEX idx_user_id_created_at (user_id, created_at DESC);
 
+DROP TABLE IF EXISTS ride_payments;
+CREATE TABLE ride_payments
+(
+  ride_id            VARCHAR(26)  NOT NULL COMMENT 'ライドID',
+  user_id            VARCHAR(26)  NOT NULL COMMENT 'ユーザーID',
+  token              VARCHAR(255) NOT NULL COMMENT '決済に使用した決済トークン',
+  amount             INTEGER      NOT NULL COMMENT '決済額',
+  gateway_payment_id VARCHAR(255) NULL     COMMENT '決済マイクロサービス上の決済ID',
+  created_at         DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '決済日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドの決済情報テーブル';
+ALTER TABLE ride_payments ADD INDEX (token);
+
+DROP TABLE IF EXISTS ride_refunds;
+CREATE TABLE ride_refunds
+(
+  id                VARCHAR(26)  NOT NULL COMMENT '返金ID',
+  ride_id           VARCHAR(26)  NOT NULL COMMENT 'ライドID',
+  amount            INTEGER      NOT NULL COMMENT '返金額',
+  reason            VARCHAR(255) NOT NULL DEFAULT '' COMMENT '返金理由',
+  requested_by      ENUM ('OWNER', 'ADMIN') NOT NULL COMMENT '返金を要求した主体',
+  requester_id      VARCHAR(26)  NULL     COMMENT '返金を要求したオーナーのID',
+  gateway_refund_id VARCHAR(255) NULL     COMMENT '決済マイクロサービス上の返金ID',
+  status            ENUM ('PENDING', 'COMPLETED', 'FAILED') NOT NULL DEFAULT 'PENDING' COMMENT '決済マイクロサービスでの返金の状態',
+  created_at        DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '返金日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'ライドの返金履歴テーブル';
+ALTER TABLE ride_refunds ADD INDEX (ride_id);
+
+DROP TABLE IF EXISTS chair_sales_hourly;
+CREATE TABLE chair_sales_hourly
+(
+  chair_id       VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  bucket_start   DATETIME    NOT NULL COMMENT '集計期間の開始日時(UTC, 1時間単位)',
+  sales          INTEGER     NOT NULL DEFAULT 0 COMMENT '売上(決済額 - 返金額)',
+  rides_count    INTEGER     NOT NULL DEFAULT 0 COMMENT '完了したライド数',
+  evaluation_sum INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  distance       INTEGER     NOT NULL DEFAULT 0 COMMENT 'ライドの移動距離の合計',
+  PRIMARY KEY (chair_id, bucket_start)
+)
+  COMMENT = '椅子の時間別売上集計テーブル';
+
 DROP TABLE IF EXISTS ride_statuses;
 CREATE TABLE ride_statuses
 (
   id              VARCHAR(26)                                                                NOT NULL,
   ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'WAYPOINT', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
   created_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
   app_sent_at     DATETIME(6)                                                                NULL COMMENT 'ユーザーへの状態通知日時',
   chair_sent_at   DATETIME(6)                                                                NULL COMMENT '椅子への状態通知日時',
+  waypoint_seq    INTEGER                                                                    NULL INVISIBLE COMMENT '到着した経由地の順番(WAYPOINTのみ)',
   PRIMARY KEY (id)
 )
   COMMENT = 'ライドステータスの変更履歴テーブル';
 ALTER TABLE ride_statuses ADD INDEX (ride_id, created_at DESC, status);
 ALTER TABLE ride_statuses ADD INDEX (ride_id, chair_sent_at);
 
+DROP TABLE IF EXISTS ride_waypoints;
+CREATE TABLE ride_waypoints
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  seq        INTEGER     NOT NULL COMMENT '経由する順番(0始まり)',
+  latitude   INTEGER     NOT NULL COMMENT '経由地(経度)',
+  longitude  INTEGER     NOT NULL COMMENT '経由地(緯度)',
+  reached_at DATETIME(6) NULL     COMMENT '経由地に到着した日時',
+  PRIMARY KEY (ride_id, seq)
+)
+  COMMENT = 'ライドの経由地テーブル';
+
+DROP TABLE IF EXISTS ride_reviews;
+CREATE TABLE ride_reviews
+(
+  ride_id    VARCHAR(26)  NOT NULL COMMENT 'ライドID',
+  chair_id   VARCHAR(26)  NOT NULL COMMENT '評価された椅子ID',
+  comment    TEXT         NOT NULL COMMENT 'コメント',
+  tags       VARCHAR(255) NOT NULL COMMENT 'カンマ区切りのタグ',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '評価日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドの評価に添えられたコメントとタグのテーブル';
+ALTER TABLE ride_reviews ADD INDEX (chair_id, ride_id);
+
+DROP TABLE IF EXISTS chair_review_tag_counts;
+CREATE TABLE chair_review_tag_counts
+(
+  chair_id VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  tag      VARCHAR(30) NOT NULL COMMENT 'タグ',
+  count    INTEGER     NOT NULL COMMENT '付けられた回数',
+  PRIMARY KEY (chair_id, tag)
+)
+  COMMENT = '椅子ごとの評価のタグの集計テーブル';
+
+DROP TABLE IF EXISTS rider_ratings;
+CREATE TABLE rider_ratings
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  user_id    VARCHAR(26) NOT NULL COMMENT '評価されたユーザーID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '評価した椅子ID',
+  rating     INTEGER     NOT NULL COMMENT '評価',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '評価日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = '椅子による利用者の評価テーブル';
+ALTER TABLE rider_ratings ADD INDEX (user_id);
+
 DROP TABLE IF EXISTS owners;
 CREATE TABLE owners
 (
   id                   VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
   name                 VARCHAR(30)  NOT NULL COMMENT 'オーナー名',
-  access_token         VARCHAR(255) NOT NULL COMMENT 'アクセストークン',
-  chair_register_token VARCHAR(255) NOT NULL COMMENT '椅子登録トークン',
+  access_token         VARCHAR(255) NOT NULL COMMENT '初期データのアクセストークン。セッションに移した後 11-drop-legacy-token-columns.sql で削除する',
+  chair_register_token VARCHAR(255) NOT NULL COMMENT '初期データの椅子登録トークン。chair_register_tokens に移した後 11-drop-legacy-token-columns.sql で削除する',
   created_at           DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
   updated_at           DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
   PRIMARY KEY (id),
@@ -140,6 +289,39 @@ CREATE TABLE owners
 )
   COMMENT = '椅子のオーナー情報テーブル';
 
+DROP TABLE IF EXISTS chair_register_tokens;
+CREATE TABLE chair_register_tokens
+(
+  id         VARCHAR(26)  NOT NULL COMMENT '椅子登録トークンID',
+  owner_id   VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  token      VARCHAR(255) NOT NULL COMMENT '椅子登録トークンのハッシュ',
+  label      VARCHAR(255) NOT NULL DEFAULT '' COMMENT 'オーナーが付けたラベル',
+  max_uses   INTEGER      NULL     COMMENT '椅子を登録できる回数の上限',
+  used_count INTEGER      NOT NULL DEFAULT 0 COMMENT '椅子を登録した回数',
+  expires_at DATETIME(6)  NULL     COMMENT '有効期限',
+  revoked_at DATETIME(6)  NULL     COMMENT '失効日時',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  updated_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (token)
+)
+  COMMENT = '椅子登録トークンテーブル';
+ALTER TABLE chair_register_tokens ADD INDEX (owner_id, created_at);
+
+DROP TABLE IF EXISTS sessions;
+CREATE TABLE sessions
+(
+  token        VARCHAR(255) NOT NULL COMMENT 'アクセストークンのハッシュ',
+  role         ENUM ('APP', 'OWNER', 'CHAIR') NOT NULL COMMENT '認証主体の種類',
+  principal_id VARCHAR(26)  NOT NULL COMMENT 'ユーザー、オーナー、椅子のいずれかのID',
+  expires_at   DATETIME(6)  NOT NULL COMMENT '有効期限',
+  revoked_at   DATETIME(6)  NULL     COMMENT '失効日時',
+  created_at   DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  PRIMARY KEY (token)
+)
+  COMMENT = 'セッションテーブル';
+ALTER TABLE sessions ADD INDEX (role, principal_id);
+
 DROP TABLE IF EXISTS coupons;
 CREATE TABLE coupons
 (
@@ -160,10 +342,13 @@ CREATE TRIGGER trg_ride_statuses_after_insert
 AFTER INSERT ON ride_statuses
 FOR EACH ROW
 BEGIN
-  UPDATE rides
-    SET latest_status = NEW.status,
-        updated_at    = NEW.created_at
-  WHERE id = NEW.ride_id;
+  -- 経由地への到着はライドの状態を変えない
+  IF NEW.status <> 'WAYPOINT' THEN
+    UPDATE rides
+      SET latest_status = NEW.status,
+          updated_at    = NEW.created_at
+    WHERE id = NEW.ride_id;
+  END IF;
 END//
 DELIMITER ;
 
@@ -0,0 +1,3 @@
+-- 初期データのライドには経由地が無いので、配車位置から目的地までの距離をライドの移動距離とする
+UPDATE rides
+SET distance = ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude);
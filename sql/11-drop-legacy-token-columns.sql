@@ -0,0 +1,5 @@
+-- 認証は sessions と chair_register_tokens だけで行う。
+-- 初期データのトークンは 7-seed-sessions.sql と 9-seed-chair-register-tokens.sql で移したので、元のカラムは削除する
+ALTER TABLE users DROP COLUMN access_token;
+ALTER TABLE owners DROP COLUMN access_token, DROP COLUMN chair_register_token;
+ALTER TABLE chairs DROP COLUMN access_token;
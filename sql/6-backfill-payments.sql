@@ -0,0 +1,18 @@
+-- 既存の決済トークンはユーザーごとに1つだけなので、すべてデフォルトにする
+UPDATE payment_tokens SET is_default = TRUE;
+
+-- 既存の完了済みライドの決済内容を記録する
+-- 決済額は calculateDiscountedFare と同じく、初乗り運賃 + 割引後の距離運賃
+-- @initial_fare と @fare_per_distance は init.sh が Go の initialFare と farePerDistance から設定する
+-- 決済マイクロサービス上の決済IDは記録されていないので gateway_payment_id は NULL のままにする。
+-- そのため初期データのライドは返金できず、返金APIは 409 を返す
+INSERT INTO ride_payments (ride_id, user_id, token, amount, created_at)
+SELECT r.id,
+       r.user_id,
+       pt.token,
+       @initial_fare + GREATEST(@fare_per_distance * (ABS(r.pickup_latitude - r.destination_latitude) + ABS(r.pickup_longitude - r.destination_longitude)) - COALESCE(c.discount, 0), 0),
+       r.updated_at
+FROM rides r
+INNER JOIN payment_tokens pt ON pt.user_id = r.user_id
+LEFT JOIN coupons c ON c.used_by = r.id
+WHERE r.latest_status = 'COMPLETED';
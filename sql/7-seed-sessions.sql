@@ -0,0 +1,11 @@
+-- 初期データの利用者、オーナー、椅子のアクセストークンをセッションとして登録する
+-- 有効期限は go/sessions.go の sessionTTL に合わせる
+-- トークンは平文のまま登録し、初期化時に go/tokens.go の migrateTokenHashes でハッシュに置き換える
+INSERT INTO sessions (token, role, principal_id, expires_at)
+SELECT access_token, 'APP', id, NOW(6) + INTERVAL 7 DAY FROM users;
+
+INSERT INTO sessions (token, role, principal_id, expires_at)
+SELECT access_token, 'OWNER', id, NOW(6) + INTERVAL 7 DAY FROM owners;
+
+INSERT INTO sessions (token, role, principal_id, expires_at)
+SELECT access_token, 'CHAIR', id, NOW(6) + INTERVAL 7 DAY FROM chairs;
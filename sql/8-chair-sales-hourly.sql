@@ -0,0 +1,14 @@
+-- 既存の完了済みライドから椅子の時間別売上集計を作る
+-- 6-backfill-payments.sql で記録した決済額を売上とする
+INSERT INTO chair_sales_hourly (chair_id, bucket_start, sales, rides_count, evaluation_sum, distance)
+SELECT r.chair_id,
+       DATE_FORMAT(rs.created_at, '%Y-%m-%d %H:00:00'),
+       SUM(p.amount),
+       COUNT(*),
+       SUM(COALESCE(r.evaluation, 0)),
+       SUM(ABS(r.pickup_latitude - r.destination_latitude) + ABS(r.pickup_longitude - r.destination_longitude))
+FROM rides r
+INNER JOIN ride_statuses rs ON rs.ride_id = r.id AND rs.status = 'COMPLETED'
+INNER JOIN ride_payments p ON p.ride_id = r.id
+WHERE r.chair_id IS NOT NULL
+GROUP BY r.chair_id, DATE_FORMAT(rs.created_at, '%Y-%m-%d %H:00:00');
@@ -0,0 +1,4 @@
+-- 初期データのオーナーの椅子登録トークンを、回数・期限の制限なしの椅子登録トークンとして登録する
+-- トークンは平文のまま登録し、初期化時に go/tokens.go の migrateTokenHashes でハッシュに置き換える
+INSERT INTO chair_register_tokens (id, owner_id, token, label, created_at)
+SELECT id, id, chair_register_token, 'default', created_at FROM owners;